@@ -0,0 +1,169 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// staticCollector exports metrics for a single response, so historical samples
+// can go through the same gauges as the live collector.
+type staticCollector struct {
+	metrics []Metric
+	data    any
+}
+
+func (c staticCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, metric := range c.metrics {
+		ch <- metric.Desc()
+	}
+}
+
+func (c staticCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, c.metrics, c.data)
+}
+
+// openMetricsWriter accumulates timestamped samples per metric family, as
+// OpenMetrics requires every sample of a family to be written together.
+type openMetricsWriter struct {
+	families map[string]*dto.MetricFamily
+}
+
+func newOpenMetricsWriter() *openMetricsWriter {
+	return &openMetricsWriter{families: make(map[string]*dto.MetricFamily)}
+}
+
+func (w *openMetricsWriter) add(metrics []Metric, data any, ts time.Time) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(staticCollector{metrics, data}); err != nil {
+		return err
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	timestamp := ts.UnixMilli()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			metric.TimestampMs = &timestamp
+		}
+		if existing, ok := w.families[family.GetName()]; ok {
+			existing.Metric = append(existing.Metric, family.Metric...)
+		} else {
+			w.families[family.GetName()] = family
+		}
+	}
+	return nil
+}
+
+// writeTo writes all samples with each series in timestamp order, assuming they
+// were added in timestamp order.
+func (w *openMetricsWriter) writeTo(out io.Writer) error {
+	names := make([]string, 0, len(w.families))
+	for name := range w.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := w.families[name]
+		sort.SliceStable(family.Metric, func(i, j int) bool {
+			return labelsLess(family.Metric[i].Label, family.Metric[j].Label)
+		})
+		if _, err := expfmt.MetricFamilyToOpenMetrics(out, family); err != nil {
+			return err
+		}
+	}
+
+	_, err := expfmt.FinalizeOpenMetrics(out)
+	return err
+}
+
+func labelsLess(a, b []*dto.LabelPair) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].GetName() != b[i].GetName() {
+			return a[i].GetName() < b[i].GetName()
+		}
+		if a[i].GetValue() != b[i].GetValue() {
+			return a[i].GetValue() < b[i].GetValue()
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Backfill writes the weather of every location from the One Call timemachine
+// endpoint between from and to as OpenMetrics, suitable for
+// promtool tsdb create-blocks-from openmetrics.
+func Backfill(out io.Writer, settings *Settings, locations []Location, from, to time.Time, step time.Duration) error {
+	locations = prepareLocations(locations, settings)
+	client := httpClient(settings)
+
+	calls := int(to.Sub(from)/step) * len(locations)
+	log.Infof("Backfilling %s to %s every %s, this will call the API %d times.", from, to, step, calls)
+
+	w := newOpenMetricsWriter()
+	for _, location := range locations {
+		metrics := OneCallGauges(location)
+		for t := from; t.Before(to); t = t.Add(step) {
+			d, err := TimeMachineByCoordinates(context.Background(), location, t, client, location.Settings)
+			if err != nil {
+				return err
+			}
+			if err := w.add(metrics, d, time.Unix(int64(d.Dt), 0)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.writeTo(out)
+}
+
+// BackfillPollution writes the hourly air pollution of every location from the
+// air_pollution/history endpoint between from and to as OpenMetrics, with one
+// API call per location.
+func BackfillPollution(out io.Writer, settings *Settings, locations []Location, from, to time.Time) error {
+	locations = prepareLocations(locations, settings)
+	client := httpClient(settings)
+
+	log.Infof("Backfilling air pollution from %s to %s, this will call the API %d times.", from, to, len(locations))
+
+	w := newOpenMetricsWriter()
+	for _, location := range locations {
+		metrics := PollutionGauges(location)
+		history, err := PollutionHistoryByCoordinates(context.Background(), location, from, to, client, location.Settings)
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(history.List, func(i, j int) bool {
+			return history.List[i].Dt < history.List[j].Dt
+		})
+		for i := range history.List {
+			if err := w.add(metrics, &history.List[i], time.Unix(int64(history.List[i].Dt), 0)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.writeTo(out)
+}
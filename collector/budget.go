@@ -0,0 +1,254 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrBudgetExhausted is returned instead of calling the API once a call budget is used up.
+var ErrBudgetExhausted = errors.New("API call budget exhausted")
+
+// Budget limits the number of API calls per UTC day and month, in total and
+// for each API key. A limit of 0 is unlimited. Budget is a prometheus
+// collector exporting the calls left. Calls are counted in memory unless
+// the budget is persisted.
+type Budget struct {
+	Daily      int
+	Monthly    int
+	KeyDaily   int
+	KeyMonthly int
+
+	mu    sync.Mutex
+	day   string
+	month string
+	total budgetUsage
+	// keys holds the usage of every API key by its hash.
+	keys map[string]*budgetUsage
+	// path is the file the counts are saved to, if persisted.
+	path string
+
+	remaining *prometheus.Desc
+}
+
+type budgetUsage struct {
+	Daily   int `json:"daily"`
+	Monthly int `json:"monthly"`
+}
+
+// budgetFile is the file of a persisted budget.
+type budgetFile struct {
+	Day   string                  `json:"day"`
+	Month string                  `json:"month"`
+	Total budgetUsage             `json:"total"`
+	Keys  map[string]*budgetUsage `json:"keys"`
+}
+
+func NewBudget(daily, monthly, keyDaily, keyMonthly int) *Budget {
+	return &Budget{
+		Daily:      daily,
+		Monthly:    monthly,
+		KeyDaily:   keyDaily,
+		KeyMonthly: keyMonthly,
+		keys:       make(map[string]*budgetUsage),
+		remaining: prometheus.NewDesc("openweather_api_budget_remaining", "Number of API calls left in the budget of the period",
+			[]string{"scope", "period", "api_key"}, nil),
+	}
+}
+
+// reset clears the counts of a day or month that has passed.
+func (b *Budget) reset(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); day != b.day {
+		b.day = day
+		b.total.Daily = 0
+		for _, usage := range b.keys {
+			usage.Daily = 0
+		}
+	}
+	if month := now.Format("2006-01"); month != b.month {
+		b.month = month
+		b.total.Monthly = 0
+		for _, usage := range b.keys {
+			usage.Monthly = 0
+		}
+	}
+}
+
+// take counts an API call with apiKey, or returns ErrBudgetExhausted if a
+// budget it falls under is used up. A nil budget is unlimited.
+func (b *Budget) take(apiKey string) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset(time.Now())
+
+	usage, ok := b.keys[hashKey(apiKey)]
+	if !ok {
+		usage = &budgetUsage{}
+		b.keys[hashKey(apiKey)] = usage
+	}
+
+	switch {
+	case exhausted(b.Daily, b.total.Daily):
+		return fmt.Errorf("%w: %d calls today", ErrBudgetExhausted, b.total.Daily)
+	case exhausted(b.Monthly, b.total.Monthly):
+		return fmt.Errorf("%w: %d calls this month", ErrBudgetExhausted, b.total.Monthly)
+	case exhausted(b.KeyDaily, usage.Daily):
+		return fmt.Errorf("%w: %d calls today with API key %s", ErrBudgetExhausted, usage.Daily, hashKey(apiKey))
+	case exhausted(b.KeyMonthly, usage.Monthly):
+		return fmt.Errorf("%w: %d calls this month with API key %s", ErrBudgetExhausted, usage.Monthly, hashKey(apiKey))
+	}
+
+	b.total.Daily++
+	b.total.Monthly++
+	usage.Daily++
+	usage.Monthly++
+	b.save()
+	return nil
+}
+
+// left returns the calls left today in total and with apiKey, or -1 where no
+// limit applies. The calls left of a month are spread over its remaining days.
+func (b *Budget) left(apiKey string, now time.Time) (total, key int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset(now)
+
+	now = now.UTC()
+	days := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day() - now.Day() + 1
+	remaining := func(daily, dailyUsed, monthly, monthlyUsed int) int {
+		left := -1
+		if daily > 0 {
+			left = max(daily-dailyUsed, 0)
+		}
+		if monthly > 0 {
+			if monthLeft := max(monthly-monthlyUsed, 0) / days; left < 0 || monthLeft < left {
+				left = monthLeft
+			}
+		}
+		return left
+	}
+
+	usage, ok := b.keys[hashKey(apiKey)]
+	if !ok {
+		usage = &budgetUsage{}
+	}
+	return remaining(b.Daily, b.total.Daily, b.Monthly, b.total.Monthly),
+		remaining(b.KeyDaily, usage.Daily, b.KeyMonthly, usage.Monthly)
+}
+
+// nextBudgetReset returns when the daily counts after now are reset, the
+// earliest a used up budget can have calls left again.
+func nextBudgetReset(now time.Time) time.Time {
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+}
+
+// Persist keeps the counts in the file at path, so a restart does not start
+// the budget over, and loads the counts of the current day and month from it.
+func (b *Budget) Persist(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read budget: %w", err)
+	}
+	var file budgetFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse budget %s: %w", path, err)
+	}
+
+	b.day, b.month, b.total = file.Day, file.Month, file.Total
+	for key, usage := range file.Keys {
+		b.keys[key] = usage
+	}
+	b.reset(time.Now())
+	return nil
+}
+
+// save writes the counts to the file of a persisted budget. It must be
+// called with the lock held.
+func (b *Budget) save() {
+	if b.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(budgetFile{Day: b.day, Month: b.month, Total: b.total, Keys: b.keys})
+	if err != nil {
+		log.Errorf("Could not encode budget: %s", err.Error())
+		return
+	}
+	// Write to a temporary file first, so a crash never leaves a partial file.
+	if err := os.WriteFile(b.path+".tmp", data, 0o644); err != nil {
+		log.Errorf("Could not write budget: %s", err.Error())
+		return
+	}
+	if err := os.Rename(b.path+".tmp", b.path); err != nil {
+		log.Errorf("Could not write budget: %s", err.Error())
+	}
+}
+
+func exhausted(limit, used int) bool {
+	return limit > 0 && used >= limit
+}
+
+// hashKey identifies an API key without exposing it.
+func hashKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Describe implements prometheus.Collector.
+func (b *Budget) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.remaining
+}
+
+// Collect implements prometheus.Collector, exporting the calls left of every
+// limited budget. Budgets per API key are exported once the key has been used.
+func (b *Budget) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset(time.Now())
+
+	collect := func(scope, period, apiKey string, limit, used int) {
+		if limit > 0 {
+			ch <- prometheus.MustNewConstMetric(b.remaining, prometheus.GaugeValue, float64(max(limit-used, 0)), scope, period, apiKey)
+		}
+	}
+
+	collect("global", "daily", "", b.Daily, b.total.Daily)
+	collect("global", "monthly", "", b.Monthly, b.total.Monthly)
+	for key, usage := range b.keys {
+		collect("key", "daily", key, b.KeyDaily, usage.Daily)
+		collect("key", "monthly", key, b.KeyMonthly, usage.Monthly)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBudgetTake(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget *Budget
+		// keys are the API keys of the calls, in order.
+		keys []string
+		// allowed is the number of calls that succeed.
+		allowed int
+	}{
+		{"unlimited", NewBudget(0, 0, 0, 0), []string{"a", "a", "a"}, 3},
+		{"nil", nil, []string{"a", "a", "a"}, 3},
+		{"daily", NewBudget(2, 0, 0, 0), []string{"a", "b", "a"}, 2},
+		{"monthly", NewBudget(0, 1, 0, 0), []string{"a", "b"}, 1},
+		{"monthly below daily", NewBudget(5, 2, 0, 0), []string{"a", "a", "a"}, 2},
+		{"key daily", NewBudget(0, 0, 2, 0), []string{"a", "a", "b", "b", "a"}, 4},
+		{"key monthly", NewBudget(0, 0, 0, 1), []string{"a", "b", "a", "b"}, 2},
+		{"global before key", NewBudget(3, 0, 2, 0), []string{"a", "b", "b", "a"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := 0
+			for i, key := range tt.keys {
+				err := tt.budget.take(key)
+				switch {
+				case err == nil:
+					allowed++
+				case !errors.Is(err, ErrBudgetExhausted):
+					t.Fatalf("take() call %d: unexpected error %v", i+1, err)
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("take() allowed %d calls, want %d", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestBudgetReset(t *testing.T) {
+	tests := []struct {
+		name                 string
+		now                  time.Time
+		daily, monthly, keys int
+	}{
+		{"same day", time.Date(2024, 5, 10, 23, 59, 0, 0, time.UTC), 3, 3, 3},
+		{"next day", time.Date(2024, 5, 11, 0, 0, 0, 0, time.UTC), 0, 3, 0},
+		{"next month", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), 0, 0, 0},
+		{"days are UTC", time.Date(2024, 5, 10, 22, 0, 0, 0, time.FixedZone("UTC-3", -3*60*60)), 0, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBudget(10, 10, 10, 10)
+			b.day, b.month = "2024-05-10", "2024-05"
+			b.total = budgetUsage{Daily: 3, Monthly: 3}
+			b.keys[hashKey("a")] = &budgetUsage{Daily: 3, Monthly: 3}
+
+			b.reset(tt.now)
+			if b.total.Daily != tt.daily || b.total.Monthly != tt.monthly {
+				t.Errorf("reset() total = %+v, want daily %d and monthly %d", b.total, tt.daily, tt.monthly)
+			}
+			if usage := b.keys[hashKey("a")]; usage.Daily != tt.keys || usage.Monthly != tt.monthly {
+				t.Errorf("reset() key = %+v, want daily %d and monthly %d", *usage, tt.keys, tt.monthly)
+			}
+		})
+	}
+}
+
+func TestBudgetPersist(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name string
+		// file is written before the budget is persisted, if not empty.
+		file                 string
+		calls                int
+		daily, monthly, keys int
+	}{
+		{"new", "", 0, 0, 0, 0},
+		{"counts", "", 2, 2, 2, 2},
+		{
+			"previous day",
+			`{"day":"2000-01-01","month":"` + now.Format("2006-01") + `","total":{"daily":4,"monthly":4},"keys":{"` + hashKey("a") + `":{"daily":4,"monthly":4}}}`,
+			1, 1, 5, 1,
+		},
+		{
+			"previous month",
+			`{"day":"2000-01-01","month":"2000-01","total":{"daily":4,"monthly":4},"keys":{}}`,
+			1, 1, 1, 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "budget.state")
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b := NewBudget(0, 0, 0, 0)
+			if err := b.Persist(path); err != nil {
+				t.Fatalf("Persist() = %v", err)
+			}
+			for i := 0; i < tt.calls; i++ {
+				if err := b.take("a"); err != nil {
+					t.Fatalf("take() = %v", err)
+				}
+			}
+
+			// A restart continues with the saved counts.
+			restarted := NewBudget(0, 0, 0, 0)
+			if err := restarted.Persist(path); err != nil {
+				t.Fatalf("Persist() after restart = %v", err)
+			}
+			if restarted.total.Daily != tt.daily || restarted.total.Monthly != tt.monthly {
+				t.Errorf("restarted total = %+v, want daily %d and monthly %d", restarted.total, tt.daily, tt.monthly)
+			}
+			if usage := restarted.keys[hashKey("a")]; tt.calls > 0 && (usage == nil || usage.Daily != tt.keys) {
+				t.Errorf("restarted key = %+v, want daily %d", usage, tt.keys)
+			}
+		})
+	}
+}
+
+func TestBudgetPersistInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.state")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBudget(1, 0, 0, 0).Persist(path); err == nil {
+		t.Error("Persist() of an invalid file succeeded")
+	}
+}
+
+func TestBudgetLeft(t *testing.T) {
+	// The 21st of a 30 day month has 10 days left.
+	now := time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		budget     *Budget
+		used       int
+		total, key int
+	}{
+		{"unlimited", NewBudget(0, 0, 0, 0), 5, -1, -1},
+		{"daily", NewBudget(10, 0, 0, 0), 4, 6, -1},
+		{"used up", NewBudget(3, 0, 0, 0), 4, 0, -1},
+		{"monthly", NewBudget(0, 100, 0, 0), 0, 10, -1},
+		{"monthly below daily", NewBudget(50, 100, 0, 0), 20, 8, -1},
+		{"key", NewBudget(0, 0, 10, 40), 2, -1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.budget.reset(now)
+			tt.budget.total = budgetUsage{Daily: tt.used, Monthly: tt.used}
+			tt.budget.keys[hashKey("a")] = &budgetUsage{Daily: tt.used, Monthly: tt.used}
+
+			total, key := tt.budget.left("a", now)
+			if total != tt.total || key != tt.key {
+				t.Errorf("left() = %d, %d, want %d, %d", total, key, tt.total, tt.key)
+			}
+		})
+	}
+}
@@ -14,13 +14,20 @@
 package collector
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jellydator/ttlcache/v2"
+	"golang.org/x/sync/singleflight"
 
 	log "github.com/sirupsen/logrus"
 
@@ -30,147 +37,735 @@ import (
 
 var notFound = ttlcache.ErrNotFound
 
+// ErrGeocode is returned for locations whose coordinates could not be looked up.
+var ErrGeocode = errors.New("could not look up location")
+
 type Settings struct {
-	ApiKey      string
-	DegreesUnit string
-	Language    string
-	EnablePol   bool
+	ApiKey           string
+	DegreesUnit      string
+	Language         string
+	EnableOneCall    bool
+	EnablePol        bool
+	EnableMinutely   bool
+	EnableHourly     bool
+	HourlyHorizons   []int
+	EnableDaily      bool
+	DailyDays        int
+	EnableAlerts     bool
+	EnableDaySummary bool
+
+	EnablePolForecast   bool
+	PolForecastHorizons []int
+
+	// CacheTTL is how long responses are cached, MaxStaleness how much
+	// longer they are served when the API fails.
+	CacheTTL     time.Duration
+	MaxStaleness time.Duration
+
+	Retry RetryPolicy
+	// Budget limits the API calls of all locations, unlimited if nil.
+	Budget *Budget
+	// DiskCache keeps cached responses across restarts, if not nil.
+	DiskCache *DiskCache
+	// Concurrency is the number of API calls made at once by all collectors,
+	// taken from the first collector created.
+	Concurrency int
+	// BaseURL of the API, DefaultBaseURL if empty.
+	BaseURL string
+	// HTTPClient calls the API, a client with a 30s timeout if nil.
+	HTTPClient *http.Client
+	// Stats count the API calls, in the default registry if nil.
+	Stats *APIStats
 }
 
 type OpenweatherCollector struct {
 	*Settings
-	Cache     *ttlcache.Cache
-	Locations []Location
+	Cache *ttlcache.Cache
 
 	client *http.Client
 
-	oneCallMetrics   map[string][]Metric
-	pollutionMetrics map[string][]Metric
+	// state is replaced as a whole on reload, so a scrape always sees a
+	// consistent set of locations and metrics.
+	state atomic.Pointer[collectorState]
+
+	// polling is set when a background poller refreshes the cache, so
+	// scrapes only read cached responses.
+	polling       atomic.Bool
+	pollerOptions PollerOptions
+
+	// lastSuccess holds the time of the last successful API request
+	// for each location and endpoint.
+	lastSuccess sync.Map
+	// budgetBlocked holds the cache keys whose last API request found the
+	// call budget used up.
+	budgetBlocked sync.Map
+}
+
+// collectorState holds the locations and the metrics of each location.
+type collectorState struct {
+	locations []Location
+
+	health map[string]healthDescs
+
+	oneCallMetrics     map[string][]Metric
+	nowcastMetrics     map[string][]Metric
+	hourlyMetrics      map[string][]Metric
+	dailyMetrics       map[string][]Metric
+	alertMetrics       map[string][]Metric
+	daySummaryMetrics  map[string][]Metric
+	pollutionMetrics   map[string][]Metric
+	polForecastMetrics map[string][]Metric
 }
 
 type Location struct {
 	Location  string
 	Latitude  float64
 	Longitude float64
+
+	// Settings of this location, the collector settings if not set.
+	Settings *Settings
+	// CacheTTL of this location, the cache TTL if not set.
+	CacheTTL time.Duration
+	// Labels added to every metric of this location.
+	Labels prometheus.Labels
+}
+
+// reservedLabels are used by the metrics themselves and cannot be set on a location.
+var reservedLabels = []string{"location", "endpoint", "horizon_hours", "day_offset", "day", "event", "sender_name", "severity", "currentconditions"}
+
+// prepareLocations defaults the settings of each location and gives every
+// location the same label names, as each metric needs consistent label names
+// across locations. Labels a location does not set are left empty.
+func prepareLocations(locations []Location, settings *Settings) []Location {
+	var names []string
+	for _, loc := range locations {
+		for name := range loc.Labels {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	res := make([]Location, len(locations))
+	for i, loc := range locations {
+		if loc.Settings == nil {
+			loc.Settings = settings
+		}
+		labels := make(prometheus.Labels, len(names))
+		for _, name := range names {
+			labels[name] = loc.Labels[name]
+		}
+		loc.Labels = labels
+		res[i] = loc
+	}
+	return res
+}
+
+// checkLabels returns an error if a label of the location clashes with a
+// label of a metric the location exports, which would fail every scrape.
+func checkLabels(location Location) error {
+	collector := &OpenweatherCollector{Settings: location.Settings}
+	collector.state.Store(newCollectorState([]Location{location}, location.Settings))
+	return prometheus.NewRegistry().Register(collector)
 }
 
-func resolveLocations(locations string) []Location {
+// parseLocation parses a location given as coordinates, such as
+// "name=Office HQ;lat=47.61;lon=-122.33". ok is false for any other location,
+// which has to be geocoded. The name defaults to the coordinates.
+func parseLocation(location string) (loc Location, ok bool, err error) {
+	var hasLat, hasLon bool
+	for _, field := range strings.Split(location, ";") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return Location{}, false, nil
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "name":
+			loc.Location = value
+		case "lat":
+			loc.Latitude, err = strconv.ParseFloat(value, 64)
+			hasLat = true
+		case "lon":
+			loc.Longitude, err = strconv.ParseFloat(value, 64)
+			hasLon = true
+		default:
+			return Location{}, false, nil
+		}
+		if err != nil {
+			return Location{}, true, fmt.Errorf("invalid coordinates in %q: %w", location, err)
+		}
+	}
+	if !hasLat || !hasLon {
+		return Location{}, true, fmt.Errorf("location %q needs both lat and lon", location)
+	}
+	if loc.Location == "" {
+		loc.Location = fmt.Sprintf("%g,%g", loc.Latitude, loc.Longitude)
+	}
+	return loc, true, nil
+}
+
+// ResolveLocations parses locations separated by a pipe and looks up the
+// coordinates of every location not given as coordinates. Locations that
+// could not be looked up are left out and reported with ErrGeocode.
+func ResolveLocations(locations string) ([]Location, error) {
 	var res []Location
+	var errs []error
 
 	for _, location := range strings.Split(locations, "|") {
+		// Use explicit coordinates as is.
+		loc, ok, err := parseLocation(location)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, loc)
+			continue
+		}
+
 		// Get Coords.
 		latitude, longitude, err := geo.GetCoords(location)
 		if err != nil {
-			log.Fatal("failed to resolve location:", err)
+			errs = append(errs, fmt.Errorf("%w %s: %w", ErrGeocode, location, err))
+			continue
 		}
 		res = append(res, Location{Location: location, Latitude: latitude, Longitude: longitude})
 	}
-	return res
+	return res, errors.Join(errs...)
+}
+
+// locationKey identifies a location by its name and coordinates, so probes
+// of the same name elsewhere do not share cached responses with it.
+func locationKey(location Location) string {
+	return fmt.Sprintf("%s@%g,%g", location.Location, location.Latitude, location.Longitude)
+}
+
+// cacheKey identifies the response of an endpoint for a location, keeping
+// responses in different units or languages apart.
+func cacheKey(location Location, endpoint string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", locationKey(location), endpoint, location.Settings.DegreesUnit, location.Settings.Language)
 }
 
 // NewOpenweatherCollector You must create a constructor for your collector that
 // initializes every descriptor and returns a pointer to the collector
-func NewOpenweatherCollector(settings *Settings, locationsStr string, cache *ttlcache.Cache) *OpenweatherCollector {
-	locations := resolveLocations(locationsStr)
+func NewOpenweatherCollector(settings *Settings, locations []Location, cache *ttlcache.Cache) *OpenweatherCollector {
+	collector := &OpenweatherCollector{
+		Settings: settings,
+		Cache:    cache,
+		client:   httpClient(settings),
+	}
+	workersOnce.Do(func() {
+		workers = make(chan struct{}, max(settings.Concurrency, 1))
+	})
+	collector.state.Store(newCollectorState(locations, settings))
+	return collector
+}
+
+func newCollectorState(locations []Location, settings *Settings) *collectorState {
+	locations = prepareLocations(locations, settings)
 
-	oneCallMetrics := make(map[string][]Metric)
-	pollutionMetrics := make(map[string][]Metric)
+	state := &collectorState{
+		locations:          locations,
+		health:             make(map[string]healthDescs),
+		oneCallMetrics:     make(map[string][]Metric),
+		nowcastMetrics:     make(map[string][]Metric),
+		hourlyMetrics:      make(map[string][]Metric),
+		dailyMetrics:       make(map[string][]Metric),
+		alertMetrics:       make(map[string][]Metric),
+		daySummaryMetrics:  make(map[string][]Metric),
+		pollutionMetrics:   make(map[string][]Metric),
+		polForecastMetrics: make(map[string][]Metric),
+	}
 	for _, loc := range locations {
-		oneCallMetrics[loc.Location] = OneCallGauges(loc.Location)
+		state.health[loc.Location] = newHealthDescs(loc)
+
+		if loc.Settings.EnableOneCall {
+			state.oneCallMetrics[loc.Location] = OneCallGauges(loc)
+		}
 
-		if settings.EnablePol {
-			pollutionMetrics[loc.Location] = PollutionGauges(loc.Location)
+		if loc.Settings.EnableMinutely {
+			state.nowcastMetrics[loc.Location] = NowcastGauges(loc)
+		}
+
+		if loc.Settings.EnableHourly {
+			state.hourlyMetrics[loc.Location] = HourlyForecastGauges(loc, loc.Settings.HourlyHorizons)
+		}
+
+		if loc.Settings.EnableDaily {
+			state.dailyMetrics[loc.Location] = DailyForecastGauges(loc, loc.Settings.DailyDays)
+		}
+
+		if loc.Settings.EnableAlerts {
+			state.alertMetrics[loc.Location] = AlertGauges(loc)
+		}
+
+		if loc.Settings.EnableDaySummary {
+			state.daySummaryMetrics[loc.Location] = DaySummaryGauges(loc)
+		}
+
+		if loc.Settings.EnablePol {
+			state.pollutionMetrics[loc.Location] = PollutionGauges(loc)
+		}
+
+		if loc.Settings.EnablePolForecast {
+			state.polForecastMetrics[loc.Location] = PollutionForecastGauges(loc, loc.Settings.PolForecastHorizons)
 		}
 	}
+	return state
+}
 
-	return &OpenweatherCollector{
-		Settings:  settings,
-		Locations: locations,
-		Cache:     cache,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		oneCallMetrics:   oneCallMetrics,
-		pollutionMetrics: pollutionMetrics,
+// Locations returns the locations currently collected.
+func (collector *OpenweatherCollector) Locations() []Location {
+	return collector.state.Load().locations
+}
+
+// Reload replaces the collected locations. Cached responses are kept for every
+// location whose coordinates and settings are unchanged.
+func (collector *OpenweatherCollector) Reload(locations []Location) {
+	state := newCollectorState(locations, collector.Settings)
+
+	previous := make(map[string]Location)
+	for _, loc := range collector.Locations() {
+		previous[loc.Location] = loc
+	}
+	current := make(map[string]bool)
+	for _, loc := range state.locations {
+		current[loc.Location] = true
+		if old, ok := previous[loc.Location]; ok && !locationChanged(old, loc) {
+			delete(previous, loc.Location)
+		}
+	}
+	for name := range previous {
+		if !current[name] {
+			collector.apiStats().forget(name)
+		}
 	}
+	for _, key := range collector.Cache.GetKeys() {
+		for _, loc := range previous {
+			if strings.HasPrefix(key, locationKey(loc)+":") {
+				_ = collector.Cache.Remove(key)
+				collector.DiskCache.remove(key)
+				collector.budgetBlocked.Delete(key)
+			}
+		}
+	}
+
+	collector.state.Store(state)
+}
+
+func locationChanged(old, loc Location) bool {
+	return old.Latitude != loc.Latitude || old.Longitude != loc.Longitude ||
+		!reflect.DeepEqual(*old.Settings, *loc.Settings)
 }
 
 // Describe Each and every collector must implement the Describe function.
 // It essentially writes all descriptors to the prometheus desc channel.
 func (collector *OpenweatherCollector) Describe(ch chan<- *prometheus.Desc) {
-	for _, metrics := range collector.oneCallMetrics {
-		for _, metric := range metrics {
-			ch <- metric.Desc()
-		}
+	state := collector.state.Load()
+	for _, health := range state.health {
+		ch <- health.up
+		ch <- health.lastSuccess
+		ch <- health.dataAge
+		ch <- health.stale
 	}
-
-	for _, metrics := range collector.pollutionMetrics {
-		for _, metric := range metrics {
-			ch <- metric.Desc()
+	for _, family := range []map[string][]Metric{
+		state.oneCallMetrics,
+		state.nowcastMetrics,
+		state.hourlyMetrics,
+		state.dailyMetrics,
+		state.alertMetrics,
+		state.daySummaryMetrics,
+		state.pollutionMetrics,
+		state.polForecastMetrics,
+	} {
+		for _, metrics := range family {
+			for _, metric := range metrics {
+				ch <- metric.Desc()
+			}
 		}
 	}
 }
 
 // Collect implements required collect function for all prometheus collectors
 func (collector *OpenweatherCollector) Collect(ch chan<- prometheus.Metric) {
-	for _, location := range collector.Locations {
-		collector.collectOneCall(location, ch)
+	collector.collect(context.Background(), ch)
+}
+
+// WithContext returns a collector for a single scrape, which gives up on API
+// calls once ctx is done.
+func (collector *OpenweatherCollector) WithContext(ctx context.Context) prometheus.Collector {
+	return &scrapeCollector{collector, ctx}
+}
 
-		if collector.Settings.EnablePol {
-			collector.collectPollution(location, ch)
+type scrapeCollector struct {
+	*OpenweatherCollector
+	ctx context.Context
+}
+
+func (scrape *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	scrape.collect(scrape.ctx, ch)
+}
+
+// collect collects all locations in parallel.
+func (collector *OpenweatherCollector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	policy := fetchOnMiss
+	if collector.polling.Load() {
+		policy = fetchNever
+	}
+
+	state := collector.state.Load()
+	var wg sync.WaitGroup
+	for _, location := range state.locations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := collector.collectLocation(ctx, state, location, policy, ch); err != nil {
+				log.Errorf("Collecting metrics failed for %s: %s", location.Location, err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// collectLocation collects every enabled endpoint of a location in parallel
+// and returns the errors of the endpoints that failed.
+func (collector *OpenweatherCollector) collectLocation(ctx context.Context, state *collectorState, location Location, policy fetchPolicy, ch chan<- prometheus.Metric) error {
+	settings := location.Settings
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	run := func(endpoint string, collect func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := collector.collectHealth(state, location, endpoint, collect(), ch)
+
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		}()
+	}
+
+	oneCallEnabled := settings.EnableOneCall || settings.EnableMinutely || settings.EnableHourly || settings.EnableDaily || settings.EnableAlerts
+	if oneCallEnabled {
+		run("onecall", func() error {
+			onecall, err := collector.collectOneCall(ctx, state, location, policy, ch)
+
+			// The day summary needs the timezone of the One Call response.
+			if settings.EnableDaySummary {
+				run("day_summary", func() error {
+					return collector.collectDaySummary(ctx, state, location, policy, onecall, ch)
+				})
+			}
+			return err
+		})
+	} else if settings.EnableDaySummary {
+		run("day_summary", func() error {
+			return collector.collectDaySummary(ctx, state, location, policy, nil, ch)
+		})
+	}
+
+	if settings.EnablePol {
+		run("pollution", func() error {
+			return collector.collectPollution(ctx, state, location, policy, ch)
+		})
+	}
+
+	if settings.EnablePolForecast {
+		run("pollution_forecast", func() error {
+			return collector.collectPollutionForecast(ctx, state, location, policy, ch)
+		})
+	}
+
+	wg.Wait()
+
+	err := errors.Join(errs...)
+	stale := 0.0
+	if errors.Is(err, errStale) {
+		stale = 1
+	}
+	ch <- prometheus.MustNewConstMetric(state.health[location.Location].stale, prometheus.GaugeValue, stale, location.Location)
+	return err
+}
+
+// collectHealth writes whether an endpoint of a location was collected and
+// when its last API request succeeded, and passes on the error.
+func (collector *OpenweatherCollector) collectHealth(state *collectorState, location Location, endpoint string, err error, ch chan<- prometheus.Metric) error {
+	health := state.health[location.Location]
+
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(health.up, prometheus.GaugeValue, up, location.Location, endpoint)
+
+	if fetched, ok := collector.lastSuccess.Load(location.Location + ":" + endpoint); ok {
+		ch <- prometheus.MustNewConstMetric(health.lastSuccess, prometheus.GaugeValue, float64(fetched.(time.Time).Unix()), location.Location, endpoint)
+	}
+	return err
+}
+
+// collectMetrics writes the latest value for each metric in the prometheus metric channel.
+func collectMetrics(ch chan<- prometheus.Metric, metrics []Metric, data any) {
+	for _, metric := range metrics {
+		for _, m := range metric.FromResponse(data) {
+			ch <- m
 		}
 	}
 }
 
-func cachedHttpRequest[T any](collector *OpenweatherCollector, key string, request func() (T, error)) (T, error) {
-	if val, err := collector.Cache.Get(key); !errors.Is(err, notFound) || val != nil {
+// fetchPolicy decides whether collecting calls the API or uses the cache.
+type fetchPolicy int
+
+const (
+	// fetchOnMiss calls the API when there is no cached response.
+	fetchOnMiss fetchPolicy = iota
+	// fetchAlways calls the API and replaces the cached response.
+	fetchAlways
+	// fetchNever only uses cached responses.
+	fetchNever
+)
+
+var errNotPolled = errors.New("no data has been polled yet")
+
+// inflight coalesces the API calls for a cache key, shared by every collector
+// as they share the cache.
+var inflight singleflight.Group
+
+// workers holds a slot for every API call in flight, up to the concurrency.
+// It is shared by every collector, so probes count towards the limit too.
+var (
+	workers     chan struct{}
+	workersOnce sync.Once
+)
+
+// acquireWorker waits for a slot to call the API and returns the function
+// releasing it. Calls are not limited without a collector.
+func acquireWorker(ctx context.Context) (func(), error) {
+	if workers == nil {
+		return func() {}, nil
+	}
+	select {
+	case workers <- struct{}{}:
+		return func() { <-workers }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrUpstream, ctx.Err())
+	}
+}
+
+// errStale is returned with a cached response that is older than its TTL,
+// because the API could not be called.
+var errStale = errors.New("serving stale data")
+
+// budgetRetention is how long responses are cached with a call budget, to
+// serve them until a used up monthly budget starts over.
+const budgetRetention = 31 * 24 * time.Hour
+
+// pastDayTTL is how long the summary of a past day is cached, until the day
+// is no longer yesterday in any timezone.
+const pastDayTTL = 48 * time.Hour
+
+// cachedResponse is a cached API response with the time it was fetched.
+type cachedResponse struct {
+	Data    any
+	Fetched time.Time
+}
+
+// cacheTTL returns the cache TTL of the location, or else of its settings.
+func cacheTTL(location Location) time.Duration {
+	if location.CacheTTL > 0 {
+		return location.CacheTTL
+	}
+	return location.Settings.CacheTTL
+}
+
+// freshFor returns how long a cached response of the location stays fresh.
+func (collector *OpenweatherCollector) freshFor(location Location) time.Duration {
+	if collector.polling.Load() {
+		// Keep polled responses until well after the next refresh is due.
+		return 2 * collector.baseInterval(collector.state.Load(), location)
+	}
+	return cacheTTL(location)
+}
+
+// cachedHttpRequest returns the cached response for key while it is younger
+// than fresh, or else calls request, depending on the policy. If the call
+// fails, a cached response kept for up to MaxStaleness past its freshness is
+// returned along with errStale and the error.
+func cachedHttpRequest[T any](ctx context.Context, collector *OpenweatherCollector, location Location, endpoint, key string, fresh time.Duration, policy fetchPolicy, request func(context.Context) (T, error)) (T, error) {
+	successKey := location.Location + ":" + endpoint
+
+	val, err := collector.Cache.Get(key)
+	cached, found := val.(cachedResponse)
+	found = found && !errors.Is(err, notFound)
+	if found {
+		if _, ok := collector.lastSuccess.Load(successKey); !ok {
+			collector.lastSuccess.Store(successKey, cached.Fetched)
+		}
+	}
+
+	if found && policy != fetchAlways && time.Since(cached.Fetched) < fresh {
 		// Grab Metrics from cache
-		return val.(T), nil
+		return cached.Data.(T), nil
+	}
+
+	var w T
+	if policy == fetchNever {
+		err = errNotPolled
 	} else {
-		// Grab Metrics
-		w, err := request()
-		if err != nil {
-			return w, err
+		// Concurrent misses of the same key share a single call. It is not
+		// canceled with the context of the caller that started it, so the
+		// other callers and the cache still get its response.
+		leader := false
+		var v any
+		ch := inflight.DoChan(key, func() (any, error) {
+			leader = true
+
+			// The response may have been refreshed since it was looked up.
+			if val, err := collector.Cache.Get(key); err == nil && policy != fetchAlways {
+				if cached := val.(cachedResponse); time.Since(cached.Fetched) < fresh {
+					return cached.Data, nil
+				}
+			}
+
+			// Grab Metrics
+			start := time.Now()
+			w, err := request(context.WithoutCancel(ctx))
+			location.Settings.apiStats().duration.WithLabelValues(location.Location, endpoint).Observe(time.Since(start).Seconds())
+			if errors.Is(err, ErrBudgetExhausted) {
+				collector.budgetBlocked.Store(key, true)
+			}
+			if err != nil {
+				return nil, err
+			}
+			collector.lastSuccess.Store(successKey, start)
+			collector.budgetBlocked.Delete(key)
+
+			// Keep the response past its TTL to serve it if the API fails,
+			// and for as long as a call budget may be used up.
+			response, keep := cachedResponse{Data: w, Fetched: start}, fresh+location.Settings.MaxStaleness
+			if location.Settings.Budget != nil {
+				keep = max(keep, budgetRetention)
+			}
+			if err := collector.Cache.SetWithTTL(key, response, keep); err != nil {
+				return w, fmt.Errorf("could not set cache data: %s", err.Error())
+			}
+			location.Settings.DiskCache.store(location, endpoint, key, response, start.Add(keep))
+			return w, nil
+		})
+		select {
+		case res := <-ch:
+			v, err = res.Val, res.Err
+			if !leader {
+				location.Settings.apiStats().coalesced.WithLabelValues(location.Location, endpoint).Inc()
+			}
+		case <-ctx.Done():
+			err = fmt.Errorf("%w: %w", ErrUpstream, ctx.Err())
 		}
-		err = collector.Cache.Set(key, w)
-		if err != nil {
-			return w, fmt.Errorf("could not set cache data: %s", err.Error())
+		if v != nil {
+			w = v.(T)
+		}
+		if err == nil {
+			return w, nil
 		}
-		return w, nil
 	}
+
+	// Serve the cached response for up to MaxStaleness past its TTL, or until
+	// a call succeeds again after the call budget was used up.
+	_, blocked := collector.budgetBlocked.Load(key)
+	if found && (time.Since(cached.Fetched) < fresh+location.Settings.MaxStaleness || blocked || errors.Is(err, ErrBudgetExhausted)) {
+		return cached.Data.(T), fmt.Errorf("%w fetched at %s: %w", errStale, cached.Fetched.Format(time.RFC3339), err)
+	}
+	return w, err
 }
 
-func (collector *OpenweatherCollector) collectOneCall(location Location, ch chan<- prometheus.Metric) {
-	w, err := cachedHttpRequest(collector, location.Location+":onecall",
-		func() (*OneCallCurrentData, error) {
-			return CurrentByCoordinates(location, collector.client, collector.Settings)
+func (collector *OpenweatherCollector) collectOneCall(ctx context.Context, state *collectorState, location Location, policy fetchPolicy, ch chan<- prometheus.Metric) (*OneCallData, error) {
+	w, err := cachedHttpRequest(ctx, collector, location, "onecall", cacheKey(location, "onecall"), collector.freshFor(location), policy,
+		func(ctx context.Context) (*OneCallData, error) {
+			return OneCallByCoordinates(ctx, location, collector.client, location.Settings)
 		},
 	)
 
-	if err != nil {
-		log.Infof("Collecting metrics failed for %s: %s", location.Location, err.Error())
-		return
+	if err != nil && !errors.Is(err, errStale) {
+		return nil, err
 	}
 
-	// Write the latest value for each metric in the prometheus metric channel.
-	for _, metric := range collector.oneCallMetrics[location.Location] {
-		ch <- metric.FromResponse(w)
+	dataAge := time.Since(time.Unix(int64(w.Current.Dt), 0)).Seconds()
+	ch <- prometheus.MustNewConstMetric(state.health[location.Location].dataAge, prometheus.GaugeValue, dataAge, location.Location)
+
+	collectMetrics(ch, state.oneCallMetrics[location.Location], &w.Current)
+	collectMetrics(ch, state.nowcastMetrics[location.Location], w)
+	collectMetrics(ch, state.hourlyMetrics[location.Location], w)
+	collectMetrics(ch, state.dailyMetrics[location.Location], w)
+	collectMetrics(ch, state.alertMetrics[location.Location], w)
+	return w, err
+}
+
+// collectDaySummary uses the timezone of the One Call response, if there is one,
+// to decide which local days are yesterday and today.
+func (collector *OpenweatherCollector) collectDaySummary(ctx context.Context, state *collectorState, location Location, policy fetchPolicy, onecall *OneCallData, ch chan<- prometheus.Metric) error {
+	now := time.Now().UTC()
+	if onecall != nil {
+		now = now.Add(time.Duration(onecall.TimezoneOffset) * time.Second)
+	}
+	today := now.Format(time.DateOnly)
+	yesterday := now.AddDate(0, 0, -1).Format(time.DateOnly)
+
+	// Yesterday is over, so its summary is only fetched once, and kept
+	// under its date until it is no longer yesterday.
+	pastPolicy := policy
+	if pastPolicy == fetchAlways {
+		pastPolicy = fetchOnMiss
+	}
+	y, yesterdayErr := cachedHttpRequest(ctx, collector, location, "day_summary", cacheKey(location, "day_summary:"+yesterday), pastDayTTL, pastPolicy,
+		func(ctx context.Context) (*DaySummaryData, error) {
+			return DaySummaryByCoordinates(ctx, location, yesterday, collector.client, location.Settings)
+		},
+	)
+	if yesterdayErr != nil && !errors.Is(yesterdayErr, errStale) {
+		return yesterdayErr
+	}
+
+	t, todayErr := cachedHttpRequest(ctx, collector, location, "day_summary", cacheKey(location, "day_summary:"+today), collector.freshFor(location), policy,
+		func(ctx context.Context) (*DaySummaryData, error) {
+			return DaySummaryByCoordinates(ctx, location, today, collector.client, location.Settings)
+		},
+	)
+	if todayErr != nil && !errors.Is(todayErr, errStale) {
+		return todayErr
 	}
+
+	collectMetrics(ch, state.daySummaryMetrics[location.Location], &DaySummaries{Yesterday: *y, Today: *t})
+	return errors.Join(yesterdayErr, todayErr)
 }
 
-func (collector *OpenweatherCollector) collectPollution(location Location, ch chan<- prometheus.Metric) {
-	w, err := cachedHttpRequest(collector, location.Location+":pollution",
-		func() (*PollutionData, error) {
-			return PollutionByCoordinates(location, collector.client, collector.Settings)
+func (collector *OpenweatherCollector) collectPollution(ctx context.Context, state *collectorState, location Location, policy fetchPolicy, ch chan<- prometheus.Metric) error {
+	w, err := cachedHttpRequest(ctx, collector, location, "pollution", locationKey(location)+":pollution", collector.freshFor(location), policy,
+		func(ctx context.Context) (*PollutionData, error) {
+			return PollutionByCoordinates(ctx, location, collector.client, location.Settings)
 		},
 	)
 
-	if err != nil {
-		log.Infof("Collecting metrics failed for %s: %s", location.Location, err.Error())
-		return
+	if err != nil && !errors.Is(err, errStale) {
+		return err
 	}
 
-	for _, metric := range collector.pollutionMetrics[location.Location] {
-		ch <- metric.FromResponse(w)
+	collectMetrics(ch, state.pollutionMetrics[location.Location], w)
+	return err
+}
+
+func (collector *OpenweatherCollector) collectPollutionForecast(ctx context.Context, state *collectorState, location Location, policy fetchPolicy, ch chan<- prometheus.Metric) error {
+	w, err := cachedHttpRequest(ctx, collector, location, "pollution_forecast", locationKey(location)+":pollution_forecast", collector.freshFor(location), policy,
+		func(ctx context.Context) (*Pollution, error) {
+			return PollutionForecastByCoordinates(ctx, location, collector.client, location.Settings)
+		},
+	)
+
+	if err != nil && !errors.Is(err, errStale) {
+		return err
 	}
+
+	collectMetrics(ch, state.polForecastMetrics[location.Location], w)
+	return err
 }
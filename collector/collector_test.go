@@ -0,0 +1,180 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v2"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		want     Location
+		ok       bool
+		err      bool
+	}{
+		{"Seattle, WA", Location{}, false, false},
+		{"name=Office HQ;lat=47.61;lon=-122.33", Location{Location: "Office HQ", Latitude: 47.61, Longitude: -122.33}, true, false},
+		{" lat = 47.61 ; lon = -122.33 ", Location{Location: "47.61,-122.33", Latitude: 47.61, Longitude: -122.33}, true, false},
+		{"lon=-122.33;lat=47.61;name=HQ", Location{Location: "HQ", Latitude: 47.61, Longitude: -122.33}, true, false},
+		{"name=HQ;zoom=3", Location{}, false, false},
+		{"name=HQ;lat=47.61", Location{}, true, true},
+		{"lat=north;lon=-122.33", Location{}, true, true},
+		{"name=HQ", Location{}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			got, ok, err := parseLocation(tt.location)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseLocation() error = %v, want error %v", err, tt.err)
+			}
+			if ok != tt.ok {
+				t.Errorf("parseLocation() ok = %v, want %v", ok, tt.ok)
+			}
+			if got.Location != tt.want.Location || got.Latitude != tt.want.Latitude || got.Longitude != tt.want.Longitude {
+				t.Errorf("parseLocation() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	lat, lon := 47.61, -122.33
+	tests := []struct {
+		name      string
+		locations []LocationConfig
+		err       string
+	}{
+		{"valid", []LocationConfig{
+			{Name: "HQ", Latitude: &lat, Longitude: &lon, Units: "C", Collectors: []string{"onecall", "pollution"}, Labels: map[string]string{"site": "hq"}},
+			{Query: "Seattle, WA"},
+		}, ""},
+		{"coordinates as name", []LocationConfig{{Latitude: &lat, Longitude: &lon}, {Name: "47.61,-122.33"}}, `location "47.61,-122.33" configured twice`},
+		{"empty", nil, "no locations configured"},
+		{"no name", []LocationConfig{{Units: "C"}}, "location needs a name, query or coordinates"},
+		{"twice", []LocationConfig{{Name: "HQ"}, {Query: "HQ"}}, `location "HQ" configured twice`},
+		{"half coordinates", []LocationConfig{{Name: "HQ", Latitude: &lat}}, `location "HQ" needs both lat and lon`},
+		{"unit", []LocationConfig{{Name: "HQ", Units: "R"}}, `location "HQ" has unknown unit R (must be C, F, or K)`},
+		{"collector", []LocationConfig{{Name: "HQ", Collectors: []string{"weekly"}}}, `location "HQ" has unknown collector weekly`},
+		{"label name", []LocationConfig{{Name: "HQ", Labels: map[string]string{"1site": "hq"}}}, `location "HQ" has invalid label name 1site`},
+		{"reserved label", []LocationConfig{{Name: "HQ", Labels: map[string]string{"location": "hq"}}}, `location "HQ" has invalid label name location`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Locations: tt.locations}
+			err := config.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("validate() = %v, want no error", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("validate() = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCachedHttpRequest(t *testing.T) {
+	errFailed := fmt.Errorf("%w: 500 Internal Server Error", ErrUpstream)
+	errBudget := fmt.Errorf("%w: 10 calls today", ErrBudgetExhausted)
+
+	tests := []struct {
+		name   string
+		policy fetchPolicy
+		// cached is the age of the cached response, none if 0.
+		cached time.Duration
+		// blocked is set if the last call found the budget used up.
+		blocked bool
+		// response of the API, nil if it must not be called.
+		response func() (string, error)
+		want     string
+		err      error
+		stale    bool
+		called   bool
+	}{
+		{"fresh", fetchOnMiss, time.Minute, false, nil, "cached", nil, false, false},
+		{"miss", fetchOnMiss, 0, false, fetched, "fetched", nil, false, true},
+		{"expired", fetchOnMiss, 6 * time.Minute, false, fetched, "fetched", nil, false, true},
+		{"always", fetchAlways, time.Minute, false, fetched, "fetched", nil, false, true},
+		{"never", fetchNever, 0, false, nil, "", errNotPolled, false, false},
+		{"never stale", fetchNever, 6 * time.Minute, false, nil, "cached", errNotPolled, true, false},
+		{"failed", fetchOnMiss, 0, false, failing(errFailed), "", ErrUpstream, false, true},
+		{"failed stale", fetchOnMiss, 10 * time.Minute, false, failing(errFailed), "cached", ErrUpstream, true, true},
+		{"failed too stale", fetchOnMiss, 20 * time.Minute, false, failing(errFailed), "", ErrUpstream, false, true},
+		{"budget exhausted", fetchOnMiss, 20 * time.Minute, false, failing(errBudget), "cached", ErrBudgetExhausted, true, true},
+		{"budget exhausted uncached", fetchOnMiss, 0, false, failing(errBudget), "", ErrBudgetExhausted, false, true},
+		{"budget blocked", fetchOnMiss, 20 * time.Minute, true, failing(errFailed), "cached", ErrUpstream, true, true},
+		{"budget unblocked", fetchOnMiss, 20 * time.Minute, true, fetched, "fetched", nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := &Settings{MaxStaleness: 10 * time.Minute}
+			location := Location{Location: tt.name, Settings: settings}
+			collector := &OpenweatherCollector{Settings: settings, Cache: ttlcache.NewCache()}
+			defer collector.Cache.Close()
+
+			key := cacheKey(location, "onecall")
+			if tt.cached > 0 {
+				response := cachedResponse{Data: "cached", Fetched: time.Now().Add(-tt.cached)}
+				if err := collector.Cache.SetWithTTL(key, response, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.blocked {
+				collector.budgetBlocked.Store(key, true)
+			}
+
+			called := false
+			got, err := cachedHttpRequest(context.Background(), collector, location, "onecall", key, 5*time.Minute, tt.policy,
+				func(context.Context) (string, error) {
+					called = true
+					return tt.response()
+				},
+			)
+			if got != tt.want {
+				t.Errorf("cachedHttpRequest() = %q, want %q", got, tt.want)
+			}
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("cachedHttpRequest() error = %v, want %v", err, tt.err)
+			}
+			if errors.Is(err, errStale) != tt.stale {
+				t.Errorf("cachedHttpRequest() error = %v, want stale %v", err, tt.stale)
+			}
+			if called != tt.called {
+				t.Errorf("cachedHttpRequest() called the API = %v, want %v", called, tt.called)
+			}
+
+			// A used up budget is remembered until a call succeeds again.
+			_, blocked := collector.budgetBlocked.Load(key)
+			if want := errors.Is(err, ErrBudgetExhausted) || tt.blocked && err != nil; blocked != want {
+				t.Errorf("budget blocked = %v, want %v", blocked, want)
+			}
+		})
+	}
+}
+
+func fetched() (string, error) {
+	return "fetched", nil
+}
+
+func failing(err error) func() (string, error) {
+	return func() (string, error) {
+		return "", err
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/billykwooten/openweather-exporter/geo"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML configuration file, listing every location to collect.
+type Config struct {
+	Locations []LocationConfig `yaml:"locations"`
+}
+
+// LocationConfig configures a single location. Anything not set defaults to
+// the command line flags.
+type LocationConfig struct {
+	// Name is the location label, defaults to the query or the coordinates.
+	Name string `yaml:"name"`
+	// Query is looked up with Nominatim when no coordinates are given.
+	Query      string            `yaml:"query"`
+	Latitude   *float64          `yaml:"lat"`
+	Longitude  *float64          `yaml:"lon"`
+	ApiKey     string            `yaml:"apikey"`
+	Units      string            `yaml:"units"`
+	Language   string            `yaml:"language"`
+	Collectors []string          `yaml:"collectors"`
+	CacheTTL   time.Duration     `yaml:"cache_ttl"`
+	Labels     map[string]string `yaml:"labels"`
+}
+
+// Collectors are the names that can be enabled per location.
+var Collectors = map[string]func(*Settings){
+	"onecall":            func(s *Settings) { s.EnableOneCall = true },
+	"minutely":           func(s *Settings) { s.EnableMinutely = true },
+	"hourly":             func(s *Settings) { s.EnableHourly = true },
+	"daily":              func(s *Settings) { s.EnableDaily = true },
+	"alerts":             func(s *Settings) { s.EnableAlerts = true },
+	"day_summary":        func(s *Settings) { s.EnableDaySummary = true },
+	"pollution":          func(s *Settings) { s.EnablePol = true },
+	"pollution_forecast": func(s *Settings) { s.EnablePolForecast = true },
+}
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// LoadConfig reads and validates the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config Config
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Locations) == 0 {
+		return errors.New("no locations configured")
+	}
+
+	names := make(map[string]bool)
+	for _, loc := range c.Locations {
+		name := loc.name()
+		if name == "" {
+			return errors.New("location needs a name, query or coordinates")
+		}
+		if names[name] {
+			return fmt.Errorf("location %q configured twice", name)
+		}
+		names[name] = true
+
+		if (loc.Latitude == nil) != (loc.Longitude == nil) {
+			return fmt.Errorf("location %q needs both lat and lon", name)
+		}
+		if loc.Units != "" {
+			if _, ok := DataUnits[loc.Units]; !ok {
+				return fmt.Errorf("location %q has unknown unit %s (must be C, F, or K)", name, loc.Units)
+			}
+		}
+		for _, collector := range loc.Collectors {
+			if _, ok := Collectors[collector]; !ok {
+				return fmt.Errorf("location %q has unknown collector %s", name, collector)
+			}
+		}
+		for label := range loc.Labels {
+			if !labelNameRE.MatchString(label) || slices.Contains(reservedLabels, label) {
+				return fmt.Errorf("location %q has invalid label name %s", name, label)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *LocationConfig) name() string {
+	switch {
+	case l.Name != "":
+		return l.Name
+	case l.Query != "":
+		return l.Query
+	case l.Latitude != nil && l.Longitude != nil:
+		return fmt.Sprintf("%g,%g", *l.Latitude, *l.Longitude)
+	}
+	return ""
+}
+
+// Resolve returns the configured locations, looking up the coordinates of
+// locations without them, and overrides defaults with their settings.
+// Locations that could not be looked up are left out and reported with ErrGeocode.
+func (c *Config) Resolve(defaults *Settings) ([]Location, error) {
+	var res []Location
+	var errs []error
+
+	for _, lc := range c.Locations {
+		loc := Location{
+			Location: lc.name(),
+			CacheTTL: lc.CacheTTL,
+			Labels:   lc.Labels,
+		}
+
+		if lc.Latitude != nil {
+			loc.Latitude, loc.Longitude = *lc.Latitude, *lc.Longitude
+		} else {
+			query := lc.Query
+			if query == "" {
+				query = lc.Name
+			}
+			latitude, longitude, err := geo.GetCoords(query)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%w %s: %w", ErrGeocode, loc.Location, err))
+				continue
+			}
+			loc.Latitude, loc.Longitude = latitude, longitude
+		}
+
+		settings := *defaults
+		if lc.ApiKey != "" {
+			settings.ApiKey = lc.ApiKey
+		}
+		if lc.Units != "" {
+			settings.DegreesUnit = lc.Units
+		}
+		if lc.Language != "" {
+			settings.Language = lc.Language
+		}
+		if lc.Collectors != nil {
+			settings.EnableOneCall, settings.EnableMinutely, settings.EnableHourly, settings.EnableDaily = false, false, false, false
+			settings.EnableAlerts, settings.EnableDaySummary, settings.EnablePol, settings.EnablePolForecast = false, false, false, false
+			for _, collector := range lc.Collectors {
+				Collectors[collector](&settings)
+			}
+		}
+		loc.Settings = &settings
+
+		if err := checkLabels(loc); err != nil {
+			return nil, fmt.Errorf("location %q has invalid labels: %w", loc.Location, err)
+		}
+		res = append(res, loc)
+	}
+	return res, errors.Join(errs...)
+}
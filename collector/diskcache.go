@@ -0,0 +1,185 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiskCache keeps a copy of every cached response in a directory, one JSON
+// file per cache key, so responses survive a restart.
+type DiskCache struct {
+	dir string
+}
+
+// diskEntry is the file of a cached response.
+type diskEntry struct {
+	Key       string          `json:"key"`
+	Endpoint  string          `json:"endpoint"`
+	Location  string          `json:"location"`
+	Latitude  float64         `json:"lat"`
+	Longitude float64         `json:"lon"`
+	Fetched   time.Time       `json:"fetched"`
+	Expires   time.Time       `json:"expires"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// endpointResponses create the response type cached for each endpoint.
+var endpointResponses = map[string]func() any{
+	"onecall":            func() any { return &OneCallData{} },
+	"day_summary":        func() any { return &DaySummaryData{} },
+	"pollution":          func() any { return &PollutionData{} },
+	"pollution_forecast": func() any { return &Pollution{} },
+}
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+func (d *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// store writes a cached response, kept until expires. A nil disk cache does nothing.
+func (d *DiskCache) store(location Location, endpoint, key string, response cachedResponse, expires time.Time) {
+	if d == nil {
+		return
+	}
+
+	data, err := json.Marshal(response.Data)
+	if err != nil {
+		log.Errorf("Could not encode cached response %s: %s", key, err.Error())
+		return
+	}
+	entry, err := json.Marshal(diskEntry{
+		Key:       key,
+		Endpoint:  endpoint,
+		Location:  location.Location,
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+		Fetched:   response.Fetched,
+		Expires:   expires,
+		Data:      data,
+	})
+	if err != nil {
+		log.Errorf("Could not encode cached response %s: %s", key, err.Error())
+		return
+	}
+
+	// Write to a temporary file first, so a crash never leaves a partial file.
+	path := d.path(key)
+	if err := os.WriteFile(path+".tmp", entry, 0o644); err != nil {
+		log.Errorf("Could not write cached response %s: %s", key, err.Error())
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Errorf("Could not write cached response %s: %s", key, err.Error())
+	}
+}
+
+// remove deletes a cached response. A nil disk cache does nothing.
+func (d *DiskCache) remove(key string) {
+	if d == nil {
+		return
+	}
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Could not remove cached response %s: %s", key, err.Error())
+	}
+}
+
+// Load puts the stored responses of the given locations into cache for the
+// rest of the time they were kept for, and deletes expired responses and
+// responses of locations that are gone or have moved. It returns the number
+// of responses loaded. A nil disk cache loads nothing.
+func (d *DiskCache) Load(cache *ttlcache.Cache, locations []Location) (int, error) {
+	if d == nil {
+		return 0, nil
+	}
+
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, fmt.Errorf("could not read cache directory: %w", err)
+	}
+
+	known := make(map[string]Location)
+	for _, loc := range locations {
+		known[loc.Location] = loc
+	}
+
+	loaded := 0
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(d.dir, file.Name())
+
+		if err := d.load(cache, path, known); err != nil {
+			log.Infof("Dropping cached response %s: %s", file.Name(), err.Error())
+			_ = os.Remove(path)
+			continue
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+func (d *DiskCache) load(cache *ttlcache.Cache, path string, known map[string]Location) error {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entry diskEntry
+	if err := json.Unmarshal(bytes, &entry); err != nil {
+		return err
+	}
+
+	ttl := time.Until(entry.Expires)
+	if ttl <= 0 {
+		return fmt.Errorf("expired at %s", entry.Expires.Format(time.RFC3339))
+	}
+	loc, ok := known[entry.Location]
+	if !ok || loc.Latitude != entry.Latitude || loc.Longitude != entry.Longitude {
+		return fmt.Errorf("location %s is no longer collected", entry.Location)
+	}
+	if !strings.HasPrefix(entry.Key, locationKey(loc)+":") {
+		return fmt.Errorf("outdated cache key %s", entry.Key)
+	}
+	newResponse, ok := endpointResponses[entry.Endpoint]
+	if !ok {
+		return fmt.Errorf("unknown endpoint %s", entry.Endpoint)
+	}
+
+	// Responses cached in another shape by an older version are dropped.
+	data := newResponse()
+	decoder := json.NewDecoder(strings.NewReader(string(entry.Data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(data); err != nil {
+		return err
+	}
+	return cache.SetWithTTL(entry.Key, cachedResponse{Data: data, Fetched: entry.Fetched}, ttl)
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultBaseURL is the OpenWeather API used if the settings have no base URL.
+const DefaultBaseURL = "https://api.openweathermap.org"
+
+// HTTPOptions configure the HTTP client calling the API.
+type HTTPOptions struct {
+	Timeout time.Duration
+	// ProxyURL is used for every request if set, or else the proxy from the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string
+	// CAFile is a PEM bundle of certificate authorities trusted in addition
+	// to the system ones, such as of a proxy intercepting TLS.
+	CAFile string
+	// UserAgent is sent with every request if set.
+	UserAgent string
+	// RecordDir is a directory to write every response to, without the API key.
+	RecordDir string
+	// ReplayDir is a directory of recorded responses to answer requests from
+	// instead of calling the API.
+	ReplayDir string
+}
+
+func NewHTTPClient(options HTTPOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if options.ProxyURL != "" {
+		proxy, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", options.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	switch {
+	case options.RecordDir != "" && options.ReplayDir != "":
+		return nil, fmt.Errorf("cannot record and replay responses at once")
+	case options.RecordDir != "":
+		record, err := newRecordTransport(transport, options.RecordDir)
+		if err != nil {
+			return nil, err
+		}
+		roundTripper = record
+	case options.ReplayDir != "":
+		replay, err := newReplayTransport(options.ReplayDir)
+		if err != nil {
+			return nil, err
+		}
+		roundTripper = replay
+	}
+	if options.UserAgent != "" {
+		roundTripper = &userAgentTransport{roundTripper, options.UserAgent}
+	}
+
+	return &http.Client{
+		Timeout:   options.Timeout,
+		Transport: roundTripper,
+	}, nil
+}
+
+// userAgentTransport sets the User-Agent of every request.
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(r)
+}
+
+// httpClient returns the HTTP client of the settings, or a default one.
+func httpClient(settings *Settings) *http.Client {
+	if settings.HTTPClient != nil {
+		return settings.HTTPClient
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+	}
+}
+
+// apiURL returns the URL of an API path, such as /data/3.0/onecall, at the
+// base URL of the settings.
+func apiURL(settings *Settings, path string) string {
+	if settings.BaseURL != "" {
+		return settings.BaseURL + path
+	}
+	return DefaultBaseURL + path
+}
@@ -14,16 +14,21 @@
 package collector
 
 import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Metric interface {
 	Desc() *prometheus.Desc
-	FromResponse(any) prometheus.Metric
+	FromResponse(any) []prometheus.Metric
 }
 
 type ApiResponse interface {
-	*OneCallCurrentData | *PollutionData
+	*OneCallData | *OneCallCurrentData | *DaySummaries | *Pollution | *PollutionData
 }
 
 type Gauge[T ApiResponse] struct {
@@ -36,22 +41,70 @@ func (g *Gauge[T]) Desc() *prometheus.Desc {
 	return g.desc
 }
 
-func (g *Gauge[T]) FromResponse(data any) prometheus.Metric {
+func (g *Gauge[T]) FromResponse(data any) []prometheus.Metric {
 	d := data.(T)
-	return prometheus.MustNewConstMetric(
+	return []prometheus.Metric{prometheus.MustNewConstMetric(
 		g.desc,
 		prometheus.GaugeValue,
 		g.extractValue(d),
 		g.extractLabelValues(d)...,
-	)
+	)}
+}
+
+// GaugeVec exports one series per item of a response, for data such as alerts
+// where the number of series is not known up front.
+type GaugeVec[T ApiResponse, E any] struct {
+	desc               *prometheus.Desc
+	extractItems       func(T) []E
+	extractValue       func(E) float64
+	extractLabelValues func(E) []string
+}
+
+func (g *GaugeVec[T, E]) Desc() *prometheus.Desc {
+	return g.desc
+}
+
+func (g *GaugeVec[T, E]) FromResponse(data any) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	for _, item := range g.extractItems(data.(T)) {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			g.desc,
+			prometheus.GaugeValue,
+			g.extractValue(item),
+			g.extractLabelValues(item)...,
+		))
+	}
+	return metrics
+}
+
+// healthDescs describe whether the endpoints of a location are collected
+// and how recent their data is.
+type healthDescs struct {
+	up          *prometheus.Desc
+	lastSuccess *prometheus.Desc
+	dataAge     *prometheus.Desc
+	stale       *prometheus.Desc
+}
+
+func newHealthDescs(location Location) healthDescs {
+	return healthDescs{
+		up: prometheus.NewDesc("openweather_up", "Whether the endpoint of the location was collected",
+			[]string{"location", "endpoint"}, location.Labels),
+		lastSuccess: prometheus.NewDesc("openweather_last_success_timestamp_seconds", "Time of the last successful API request to the endpoint of the location, unix, UTC",
+			[]string{"location", "endpoint"}, location.Labels),
+		dataAge: prometheus.NewDesc("openweather_data_age_seconds", "Age of the current weather data of the location",
+			[]string{"location"}, location.Labels),
+		stale: prometheus.NewDesc("openweather_data_stale", "Whether data of the location is served past its cache TTL because the API failed",
+			[]string{"location"}, location.Labels),
+	}
 }
 
-func OneCallGauges(location string) []Metric {
+func OneCallGauges(location Location) []Metric {
 	makeGauge := func(name, description string, extract func(*OneCallCurrentData) float64) *Gauge[*OneCallCurrentData] {
 		return &Gauge[*OneCallCurrentData]{
-			prometheus.NewDesc(name, description, []string{"location"}, nil),
+			prometheus.NewDesc(name, description, []string{"location"}, location.Labels),
 			extract,
-			func(*OneCallCurrentData) []string { return []string{location} },
+			func(*OneCallCurrentData) []string { return []string{location.Location} },
 		}
 	}
 
@@ -95,7 +148,7 @@ func OneCallGauges(location string) []Metric {
 		&Gauge[*OneCallCurrentData]{
 			prometheus.NewDesc("openweather_currentconditions",
 				"Current weather conditions",
-				[]string{"location", "currentconditions"}, nil,
+				[]string{"location", "currentconditions"}, location.Labels,
 			),
 			func(*OneCallCurrentData) float64 { return 0 },
 			func(d *OneCallCurrentData) []string {
@@ -104,48 +157,370 @@ func OneCallGauges(location string) []Metric {
 				for _, n := range d.Weather {
 					weatherDescription = n.Description
 				}
-				return []string{location, weatherDescription}
+				return []string{location.Location, weatherDescription}
 			},
 		},
 	}
 }
 
-func PollutionGauges(location string) []Metric {
-	makeGauge := func(name, description string, extract func(*PollutionData) float64) *Gauge[*PollutionData] {
-		return &Gauge[*PollutionData]{
-			prometheus.NewDesc(name, description, []string{"location"}, nil),
-			extract,
-			func(*PollutionData) []string { return []string{location} },
+// upcomingMinutely drops the minutely forecasts that have already passed, so the
+// nowcast stays accurate while the response is served from cache.
+func upcomingMinutely(d *OneCallData) []OneCallMinutelyData {
+	now := int(time.Now().Unix())
+	for i := range d.Minutely {
+		if d.Minutely[i].Dt+60 > now {
+			return d.Minutely[i:]
+		}
+	}
+	return nil
+}
+
+func NowcastGauges(location Location) []Metric {
+	makeGauge := func(name, description string, extract func([]OneCallMinutelyData) float64) *Gauge[*OneCallData] {
+		return &Gauge[*OneCallData]{
+			prometheus.NewDesc(name, description, []string{"location"}, location.Labels),
+			func(d *OneCallData) float64 {
+				// No minutely forecast is no data, rather than no precipitation.
+				if minutely := upcomingMinutely(d); len(minutely) > 0 {
+					return extract(minutely)
+				}
+				return math.NaN()
+			},
+			func(*OneCallData) []string { return []string{location.Location} },
 		}
 	}
 
 	return []Metric{
-		makeGauge("openweather_pollution_airqualityindex", "Air Quality Index. 1 = Good, 2 = Fair, 3 = Moderate, 4 = Poor, 5 = Very Poor.",
-			func(pd *PollutionData) float64 { return pd.Main.Aqi },
-		),
-		makeGauge("openweather_pollution_carbonmonoxide", "Concentration of CO (Carbon Monoxide) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.Co },
-		),
-		makeGauge("openweather_pollution_nitrogenmonoxide", "Concentration of NO (Nitrogen Monoxide) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.No },
-		),
-		makeGauge("openweather_pollution_nitrogendioxide", "Concentration of NO2 (Nitrogen Dioxide) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.No2 },
+		makeGauge("openweather_nowcast_minutes_until_precipitation", "Minutes until precipitation starts, 0 if it is precipitating now, -1 if none is expected within the hour",
+			func(minutely []OneCallMinutelyData) float64 {
+				for i, m := range minutely {
+					if m.Precipitation > 0 {
+						return float64(i)
+					}
+				}
+				return -1
+			},
 		),
-		makeGauge("openweather_pollution_ozone", "Concentration of O3 (Ozone) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.O3 },
+		makeGauge("openweather_nowcast_precipitation_max", "Maximum precipitation intensity within the next hour, in millimeters per hour",
+			func(minutely []OneCallMinutelyData) float64 {
+				var peak float64
+				for _, m := range minutely {
+					peak = math.Max(peak, m.Precipitation)
+				}
+				return peak
+			},
 		),
-		makeGauge("openweather_pollution_sulphurdioxide", "Concentration of SO2 (Sulphur Dioxide) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.So2 },
+		makeGauge("openweather_nowcast_precipitation_total", "Total precipitation expected within the next hour, in millimeters",
+			func(minutely []OneCallMinutelyData) float64 {
+				var total float64
+				for _, m := range minutely {
+					total += m.Precipitation / 60
+				}
+				return total
+			},
 		),
-		makeGauge("openweather_pollution_pm25", "Concentration of PM2.5 (Fine particles matter) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.Pm25 },
+	}
+}
+
+// hourlyForecast returns the hourly forecast covering the given number of hours
+// from now, or nil if the response does not reach that far.
+func hourlyForecast(d *OneCallData, horizon int) *OneCallHourlyData {
+	target := int(time.Now().Add(time.Duration(horizon) * time.Hour).Unix())
+	for i := range d.Hourly {
+		if target >= d.Hourly[i].Dt && target < d.Hourly[i].Dt+3600 {
+			return &d.Hourly[i]
+		}
+	}
+	return nil
+}
+
+func HourlyForecastGauges(location Location, horizons []int) []Metric {
+	var metrics []Metric
+	for _, horizon := range horizons {
+		makeGauge := func(name, description string, extract func(*OneCallHourlyData) float64) *Gauge[*OneCallData] {
+			return &Gauge[*OneCallData]{
+				prometheus.NewDesc(name, description, []string{"location", "horizon_hours"}, location.Labels),
+				func(d *OneCallData) float64 {
+					if h := hourlyForecast(d, horizon); h != nil {
+						return extract(h)
+					}
+					return math.NaN()
+				},
+				func(*OneCallData) []string { return []string{location.Location, strconv.Itoa(horizon)} },
+			}
+		}
+
+		metrics = append(metrics,
+			makeGauge("openweather_forecast_temperature", "Forecast temperature in degrees",
+				func(h *OneCallHourlyData) float64 { return h.Temp },
+			),
+			makeGauge("openweather_forecast_feelslike", "Forecast feels_like temperature in degrees",
+				func(h *OneCallHourlyData) float64 { return h.FeelsLike },
+			),
+			makeGauge("openweather_forecast_humidity", "Forecast relative humidity",
+				func(h *OneCallHourlyData) float64 { return float64(h.Humidity) },
+			),
+			makeGauge("openweather_forecast_pressure", "Forecast Atmospheric pressure hPa",
+				func(h *OneCallHourlyData) float64 { return float64(h.Pressure) },
+			),
+			makeGauge("openweather_forecast_windspeed", "Forecast Wind Speed in mph or meters/sec if imperial",
+				func(h *OneCallHourlyData) float64 { return h.WindSpeed },
+			),
+			makeGauge("openweather_forecast_winddegree", "Forecast Wind direction, degrees (meteorological)",
+				func(h *OneCallHourlyData) float64 { return h.WindDeg },
+			),
+			makeGauge("openweather_forecast_cloudiness", "Forecast Cloudiness percentage",
+				func(h *OneCallHourlyData) float64 { return float64(h.Clouds) },
+			),
+			makeGauge("openweather_forecast_precipitation_probability", "Forecast probability of precipitation, 0 to 1",
+				func(h *OneCallHourlyData) float64 { return h.Pop },
+			),
+			makeGauge("openweather_forecast_rain1h", "Forecast rain volume for the hour, in millimeters",
+				func(h *OneCallHourlyData) float64 { return h.Rain.OneH },
+			),
+			makeGauge("openweather_forecast_snow1h", "Forecast snow volume for the hour, in millimeters",
+				func(h *OneCallHourlyData) float64 { return h.Snow.OneH },
+			),
+			makeGauge("openweather_forecast_ultraviolet_index", "Forecast Ultraviolet Index",
+				func(h *OneCallHourlyData) float64 { return h.UVI },
+			),
+		)
+	}
+	return metrics
+}
+
+func DailyForecastGauges(location Location, days int) []Metric {
+	var metrics []Metric
+	for offset := 0; offset < days; offset++ {
+		makeGauge := func(name, description string, extract func(*OneCallDailyData) float64) *Gauge[*OneCallData] {
+			return &Gauge[*OneCallData]{
+				prometheus.NewDesc(name, description, []string{"location", "day_offset"}, location.Labels),
+				func(d *OneCallData) float64 {
+					if offset < len(d.Daily) {
+						return extract(&d.Daily[offset])
+					}
+					return math.NaN()
+				},
+				func(*OneCallData) []string { return []string{location.Location, strconv.Itoa(offset)} },
+			}
+		}
+
+		metrics = append(metrics,
+			makeGauge("openweather_daily_temperature_min", "Forecast minimum daily temperature in degrees",
+				func(d *OneCallDailyData) float64 { return d.Temp.Min },
+			),
+			makeGauge("openweather_daily_temperature_max", "Forecast maximum daily temperature in degrees",
+				func(d *OneCallDailyData) float64 { return d.Temp.Max },
+			),
+			makeGauge("openweather_daily_temperature_morning", "Forecast morning temperature in degrees",
+				func(d *OneCallDailyData) float64 { return d.Temp.Morn },
+			),
+			makeGauge("openweather_daily_temperature_evening", "Forecast evening temperature in degrees",
+				func(d *OneCallDailyData) float64 { return d.Temp.Eve },
+			),
+			makeGauge("openweather_daily_precipitation_probability", "Forecast probability of precipitation, 0 to 1",
+				func(d *OneCallDailyData) float64 { return d.Pop },
+			),
+			makeGauge("openweather_daily_rain", "Forecast rain volume for the day, in millimeters",
+				func(d *OneCallDailyData) float64 { return d.Rain },
+			),
+			makeGauge("openweather_daily_snow", "Forecast snow volume for the day, in millimeters",
+				func(d *OneCallDailyData) float64 { return d.Snow },
+			),
+			makeGauge("openweather_daily_moon_phase", "Moon phase. 0 and 1 are new moon, 0.25 first quarter, 0.5 full moon, 0.75 last quarter",
+				func(d *OneCallDailyData) float64 { return d.MoonPhase },
+			),
+		)
+	}
+	return metrics
+}
+
+// alertSeverity derives a severity from the alert event name. OpenWeather does not
+// return a severity, but national agencies name events after the CAP convention,
+// e.g. "Tornado Warning" or "Heat Advisory".
+func alertSeverity(event string) string {
+	event = strings.ToLower(event)
+	for _, severity := range []string{"warning", "watch", "advisory", "statement"} {
+		if strings.Contains(event, severity) {
+			return severity
+		}
+	}
+	return "unknown"
+}
+
+func alertActive(a OneCallAlert) bool {
+	now := time.Now().Unix()
+	return int64(a.Start) <= now && now < int64(a.End)
+}
+
+// uniqueAlerts returns one alert per label set, preferring active alerts and then
+// the one starting first, as agencies may issue the same event for several periods.
+func uniqueAlerts(d *OneCallData) []OneCallAlert {
+	var res []OneCallAlert
+	index := make(map[[3]string]int)
+	for _, alert := range d.Alerts {
+		key := [3]string{alert.Event, alert.SenderName, alertSeverity(alert.Event)}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(res)
+			res = append(res, alert)
+			continue
+		}
+		if active := alertActive(alert); active != alertActive(res[i]) {
+			if active {
+				res[i] = alert
+			}
+		} else if alert.Start < res[i].Start {
+			res[i] = alert
+		}
+	}
+	return res
+}
+
+func AlertGauges(location Location) []Metric {
+	makeGauge := func(name, description string, extract func(OneCallAlert) float64) *GaugeVec[*OneCallData, OneCallAlert] {
+		return &GaugeVec[*OneCallData, OneCallAlert]{
+			prometheus.NewDesc(name, description, []string{"location", "event", "sender_name", "severity"}, location.Labels),
+			uniqueAlerts,
+			extract,
+			func(a OneCallAlert) []string {
+				return []string{location.Location, a.Event, a.SenderName, alertSeverity(a.Event)}
+			},
+		}
+	}
+
+	return []Metric{
+		makeGauge("openweather_alert_active", "Whether the weather alert is currently in effect",
+			func(a OneCallAlert) float64 {
+				if alertActive(a) {
+					return 1
+				}
+				return 0
+			},
 		),
-		makeGauge("openweather_pollution_pm10", "Concentration of PM10 (Coarse particles matter) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.Pm10 },
+		makeGauge("openweather_alert_start", "Start of the weather alert, unix, UTC",
+			func(a OneCallAlert) float64 { return float64(a.Start) },
 		),
-		makeGauge("openweather_pollution_nh3", "Concentration of NH3 (Ammonia) μg/m3",
-			func(pd *PollutionData) float64 { return pd.Components.Nh3 },
+		makeGauge("openweather_alert_end", "End of the weather alert, unix, UTC",
+			func(a OneCallAlert) float64 { return float64(a.End) },
 		),
 	}
 }
+
+func DaySummaryGauges(location Location) []Metric {
+	var metrics []Metric
+	for _, day := range []string{"yesterday", "today"} {
+		makeGauge := func(name, description string, extract func(*DaySummaryData) float64) *Gauge[*DaySummaries] {
+			return &Gauge[*DaySummaries]{
+				prometheus.NewDesc(name, description, []string{"location", "day"}, location.Labels),
+				func(d *DaySummaries) float64 {
+					if day == "yesterday" {
+						return extract(&d.Yesterday)
+					}
+					return extract(&d.Today)
+				},
+				func(*DaySummaries) []string { return []string{location.Location, day} },
+			}
+		}
+
+		metrics = append(metrics,
+			makeGauge("openweather_day_summary_temperature_min", "Minimum temperature of the day in degrees",
+				func(d *DaySummaryData) float64 { return d.Temperature.Min },
+			),
+			makeGauge("openweather_day_summary_temperature_max", "Maximum temperature of the day in degrees",
+				func(d *DaySummaryData) float64 { return d.Temperature.Max },
+			),
+			makeGauge("openweather_day_summary_precipitation_total", "Total precipitation of the day, in millimeters",
+				func(d *DaySummaryData) float64 { return d.Precipitation.Total },
+			),
+			makeGauge("openweather_day_summary_humidity_afternoon", "Afternoon relative humidity",
+				func(d *DaySummaryData) float64 { return d.Humidity.Afternoon },
+			),
+			makeGauge("openweather_day_summary_windspeed_max", "Maximum Wind Speed of the day in mph or meters/sec if imperial",
+				func(d *DaySummaryData) float64 { return d.Wind.Max.Speed },
+			),
+			makeGauge("openweather_day_summary_winddegree_max", "Wind direction of the maximum wind speed, degrees (meteorological)",
+				func(d *DaySummaryData) float64 { return d.Wind.Max.Direction },
+			),
+		)
+	}
+	return metrics
+}
+
+// pollutionComponents are exported for both the current and the forecast air pollution.
+var pollutionComponents = []struct {
+	name        string
+	description string
+	extract     func(*PollutionData) float64
+}{
+	{"airqualityindex", "Air Quality Index. 1 = Good, 2 = Fair, 3 = Moderate, 4 = Poor, 5 = Very Poor.",
+		func(pd *PollutionData) float64 { return pd.Main.Aqi },
+	},
+	{"carbonmonoxide", "Concentration of CO (Carbon Monoxide) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.Co },
+	},
+	{"nitrogenmonoxide", "Concentration of NO (Nitrogen Monoxide) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.No },
+	},
+	{"nitrogendioxide", "Concentration of NO2 (Nitrogen Dioxide) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.No2 },
+	},
+	{"ozone", "Concentration of O3 (Ozone) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.O3 },
+	},
+	{"sulphurdioxide", "Concentration of SO2 (Sulphur Dioxide) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.So2 },
+	},
+	{"pm25", "Concentration of PM2.5 (Fine particles matter) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.Pm25 },
+	},
+	{"pm10", "Concentration of PM10 (Coarse particles matter) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.Pm10 },
+	},
+	{"nh3", "Concentration of NH3 (Ammonia) μg/m3",
+		func(pd *PollutionData) float64 { return pd.Components.Nh3 },
+	},
+}
+
+func PollutionGauges(location Location) []Metric {
+	var metrics []Metric
+	for _, component := range pollutionComponents {
+		metrics = append(metrics, &Gauge[*PollutionData]{
+			prometheus.NewDesc("openweather_pollution_"+component.name, component.description, []string{"location"}, location.Labels),
+			component.extract,
+			func(*PollutionData) []string { return []string{location.Location} },
+		})
+	}
+	return metrics
+}
+
+// pollutionForecast returns the hourly pollution forecast covering the given
+// number of hours from now, or nil if the response does not reach that far.
+func pollutionForecast(d *Pollution, horizon int) *PollutionData {
+	target := int(time.Now().Add(time.Duration(horizon) * time.Hour).Unix())
+	for i := range d.List {
+		if target >= d.List[i].Dt && target < d.List[i].Dt+3600 {
+			return &d.List[i]
+		}
+	}
+	return nil
+}
+
+func PollutionForecastGauges(location Location, horizons []int) []Metric {
+	var metrics []Metric
+	for _, horizon := range horizons {
+		for _, component := range pollutionComponents {
+			metrics = append(metrics, &Gauge[*Pollution]{
+				prometheus.NewDesc("openweather_pollution_forecast_"+component.name, "Forecast "+component.description, []string{"location", "horizon_hours"}, location.Labels),
+				func(d *Pollution) float64 {
+					if pd := pollutionForecast(d, horizon); pd != nil {
+						return component.extract(pd)
+					}
+					return math.NaN()
+				},
+				func(*Pollution) []string { return []string{location.Location, strconv.Itoa(horizon)} },
+			})
+		}
+	}
+	return metrics
+}
@@ -14,30 +14,125 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	DataUnits = map[string]string{"C": "metric", "F": "imperial", "K": "internal"}
+var DataUnits = map[string]string{"C": "metric", "F": "imperial", "K": "internal"}
+
+// APIStats are the metrics of the API calls made for collectors.
+type APIStats struct {
+	calls     *prometheus.CounterVec
+	retries   *prometheus.CounterVec
+	coalesced *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+}
+
+// defaultStats counts the API calls of collectors without their own stats,
+// registered with the default registry.
+var defaultStats = NewAPIStats()
 
-	apiCallCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "openweather_api_calls_total",
-		Help: "Number of API calls to openweathermap.org",
-	}, []string{"location", "endpoint", "response_status"})
+// NewAPIStats returns the API call metrics for collectors whose locations
+// should not be counted with the default registry, such as probes.
+func NewAPIStats() *APIStats {
+	return &APIStats{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openweather_api_calls_total",
+			Help: "Number of API calls to openweathermap.org",
+		}, []string{"location", "endpoint", "response_status"}),
+
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openweather_api_retries_total",
+			Help: "Number of API calls to openweathermap.org that were retried",
+		}, []string{"location", "endpoint"}),
+
+		coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openweather_api_requests_coalesced_total",
+			Help: "Number of API requests that waited for the same request already in flight instead of calling the API",
+		}, []string{"location", "endpoint"}),
+
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "openweather_request_duration_seconds",
+			Help:    "Duration of API requests for an endpoint of a location",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"location", "endpoint"}),
+	}
+}
+
+func (s *APIStats) Describe(ch chan<- *prometheus.Desc) {
+	s.calls.Describe(ch)
+	s.retries.Describe(ch)
+	s.coalesced.Describe(ch)
+	s.duration.Describe(ch)
+}
+
+func (s *APIStats) Collect(ch chan<- prometheus.Metric) {
+	s.calls.Collect(ch)
+	s.retries.Collect(ch)
+	s.coalesced.Collect(ch)
+	s.duration.Collect(ch)
+}
+
+// forget removes the series of a location.
+func (s *APIStats) forget(location string) {
+	labels := prometheus.Labels{"location": location}
+	s.calls.DeletePartialMatch(labels)
+	s.retries.DeletePartialMatch(labels)
+	s.coalesced.DeletePartialMatch(labels)
+	s.duration.DeletePartialMatch(labels)
+}
+
+// apiStats returns the stats of the settings, the default stats if not set.
+func (settings *Settings) apiStats() *APIStats {
+	if settings.Stats == nil {
+		return defaultStats
+	}
+	return settings.Stats
+}
+
+// Errors returned for failed API calls, wrapped with the details of the response.
+var (
+	// ErrUnauthorized is returned when the API key is invalid or not subscribed to the API.
+	ErrUnauthorized = errors.New("unauthorized by openweather API")
+	// ErrRateLimited is returned when the API key exceeded its rate limit.
+	ErrRateLimited = errors.New("rate limited by openweather API")
+	// ErrUpstream is returned when the API could not be reached or failed.
+	ErrUpstream = errors.New("openweather API request failed")
 )
 
 func init() {
-	prometheus.MustRegister(apiCallCounter)
+	prometheus.MustRegister(defaultStats)
+}
+
+// oneCallExclude lists the One Call blocks that are not needed for the enabled metrics.
+func oneCallExclude(settings *Settings) string {
+	var exclude []string
+	if !settings.EnableMinutely {
+		exclude = append(exclude, "minutely")
+	}
+	if !settings.EnableHourly {
+		exclude = append(exclude, "hourly")
+	}
+	if !settings.EnableDaily {
+		exclude = append(exclude, "daily")
+	}
+	if !settings.EnableAlerts {
+		exclude = append(exclude, "alerts")
+	}
+	return strings.Join(exclude, ",")
 }
 
-func CurrentByCoordinates(loc Location, client *http.Client, settings *Settings) (*OneCallCurrentData, error) {
+func OneCallByCoordinates(ctx context.Context, loc Location, client *http.Client, settings *Settings) (*OneCallData, error) {
 	var onecall OneCallData
 
 	units, ok := DataUnits[settings.DegreesUnit]
@@ -45,86 +140,203 @@ func CurrentByCoordinates(loc Location, client *http.Client, settings *Settings)
 		return nil, fmt.Errorf("unknown unit %s (must be C, F, or K)", settings.DegreesUnit)
 	}
 
-	endpoint := "https://api.openweathermap.org/data/3.0/onecall"
-
 	q := url.Values{}
 	q.Set("appid", settings.ApiKey)
 	q.Set("lat", fmt.Sprint(loc.Latitude))
 	q.Set("lon", fmt.Sprint(loc.Longitude))
 	q.Set("units", units)
 	q.Set("lang", settings.Language)
-	q.Set("excludes", "minutely,hourly,daily,alerts")
-
-	u, _ := url.Parse(endpoint)
-	u.RawQuery = q.Encode()
+	q.Set("exclude", oneCallExclude(settings))
 
 	log.Infof("Gathering Metrics from Openweather API 3.0 for %s, Lat:%f, Lon:%f", loc.Location, loc.Latitude, loc.Longitude)
-	response, err := client.Get(u.String())
-
-	// Success is indicated with 2xx status codes:
-	statusOK := response.StatusCode >= 200 && response.StatusCode < 300
-	if !statusOK {
-		log.Fatal("Non-OK HTTP status when hitting openweather API, is your API Key correct and did you sign up for the 3.0 API plan?"+" Response given was: ", response.Status+". If you have not signed up for the free or paid subscription for the 3.0 API, please see https://openweathermap.org/price, after activation it might take 1-4 hours for their API to accept your API key, there is nothing I can do about this as it's server-side.")
+	err := getJSON(ctx, loc, client, settings, apiURL(settings, "/data/3.0/onecall"), q, &onecall)
+	if errors.Is(err, ErrUnauthorized) {
+		return nil, fmt.Errorf("%w. Is your API Key correct and did you sign up for the 3.0 API plan? If you have not signed up for the free or paid subscription for the 3.0 API, please see https://openweathermap.org/price, after activation it might take 1-4 hours for their API to accept your API key, there is nothing I can do about this as it's server-side", err)
+	} else if err != nil {
+		return nil, err
 	}
 
-	if response != nil {
-		apiCallCounter.WithLabelValues(loc.Location, endpoint, response.Status).Inc()
+	return &onecall, nil
+}
+
+// TimeMachineByCoordinates returns the weather at a location for a moment in the past.
+func TimeMachineByCoordinates(ctx context.Context, loc Location, dt time.Time, client *http.Client, settings *Settings) (*OneCallCurrentData, error) {
+	var timemachine OneCallTimeMachineData
+
+	units, ok := DataUnits[settings.DegreesUnit]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %s (must be C, F, or K)", settings.DegreesUnit)
 	}
 
-	if err != nil {
+	q := url.Values{}
+	q.Set("appid", settings.ApiKey)
+	q.Set("lat", fmt.Sprint(loc.Latitude))
+	q.Set("lon", fmt.Sprint(loc.Longitude))
+	q.Set("dt", fmt.Sprint(dt.Unix()))
+	q.Set("units", units)
+	q.Set("lang", settings.Language)
+
+	if err := getJSON(ctx, loc, client, settings, apiURL(settings, "/data/3.0/onecall/timemachine"), q, &timemachine); err != nil {
 		return nil, err
 	}
+	if len(timemachine.Data) == 0 {
+		return nil, fmt.Errorf("no historical data for %s at %s", loc.Location, dt)
+	}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
+	return &timemachine.Data[0], nil
+}
 
-		}
-	}(response.Body)
+// DaySummaryByCoordinates returns the aggregated weather of a location for a date, YYYY-MM-DD.
+func DaySummaryByCoordinates(ctx context.Context, loc Location, date string, client *http.Client, settings *Settings) (*DaySummaryData, error) {
+	var summary DaySummaryData
 
-	if bytes, err := io.ReadAll(response.Body); err != nil {
-		return nil, err
-	} else if err := json.Unmarshal(bytes, &onecall); err != nil {
+	units, ok := DataUnits[settings.DegreesUnit]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %s (must be C, F, or K)", settings.DegreesUnit)
+	}
+
+	q := url.Values{}
+	q.Set("appid", settings.ApiKey)
+	q.Set("lat", fmt.Sprint(loc.Latitude))
+	q.Set("lon", fmt.Sprint(loc.Longitude))
+	q.Set("date", date)
+	q.Set("units", units)
+	q.Set("lang", settings.Language)
+
+	if err := getJSON(ctx, loc, client, settings, apiURL(settings, "/data/3.0/onecall/day_summary"), q, &summary); err != nil {
 		return nil, err
 	}
 
-	return &onecall.Current, nil
+	return &summary, nil
 }
 
-func PollutionByCoordinates(loc Location, client *http.Client, settings *Settings) (*PollutionData, error) {
+func PollutionByCoordinates(ctx context.Context, loc Location, client *http.Client, settings *Settings) (*PollutionData, error) {
 	var pollution Pollution
 
-	endpoint := "https://api.openweathermap.org/data/2.5/air_pollution"
-
 	q := url.Values{}
 	q.Set("appid", settings.ApiKey)
 	q.Set("lat", fmt.Sprint(loc.Latitude))
 	q.Set("lon", fmt.Sprint(loc.Longitude))
 
+	if err := getJSON(ctx, loc, client, settings, apiURL(settings, "/data/2.5/air_pollution"), q, &pollution); err != nil {
+		return nil, err
+	}
+	if len(pollution.List) == 0 {
+		return nil, fmt.Errorf("%w: no air pollution data for %s", ErrUpstream, loc.Location)
+	}
+
+	return &pollution.List[0], nil
+}
+
+// getJSON calls endpoint with the given query and decodes the JSON response into v,
+// retrying failed calls according to the retry policy of the settings. Every call
+// is taken from the budget of the settings and waits for a worker slot.
+func getJSON(ctx context.Context, loc Location, client *http.Client, settings *Settings, endpoint string, q url.Values, v any) error {
 	u, _ := url.Parse(endpoint)
 	u.RawQuery = q.Encode()
 
-	response, err := client.Get(u.String())
+	for attempt := 1; ; attempt++ {
+		// Hold a worker slot only while calling the API, not while waiting
+		// to retry.
+		release, err := acquireWorker(ctx)
+		if err != nil {
+			return err
+		}
+		if err := settings.Budget.take(settings.ApiKey); err != nil {
+			release()
+			return err
+		}
+		bytes, status, header, err := get(ctx, loc, client, settings.apiStats(), endpoint, u.String())
+		release()
+		if err == nil {
+			if err := json.Unmarshal(bytes, v); err != nil {
+				return fmt.Errorf("response: %s; error: %s", string(bytes), err.Error())
+			}
+			return nil
+		}
+
+		if attempt >= settings.Retry.MaxAttempts || !retryable(status) {
+			return err
+		}
+		wait, ok := settings.Retry.backoff(attempt, status, header)
+		if !ok {
+			return err
+		}
+
+		settings.apiStats().retries.WithLabelValues(loc.Location, endpoint).Inc()
+		log.Infof("Retrying %s for %s in %s: %s", endpoint, loc.Location, wait, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// get makes a single call to the API and returns the body of a successful
+// response. status is 0 if there was no response.
+func get(ctx context.Context, loc Location, client *http.Client, stats *APIStats, endpoint string, u string) (body []byte, status int, header http.Header, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	response, err := client.Do(request)
 
 	if response != nil {
-		apiCallCounter.WithLabelValues(loc.Location, endpoint, response.Status).Inc()
+		stats.calls.WithLabelValues(loc.Location, endpoint, response.Status).Inc()
+	}
+
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("%w: %w", ErrUpstream, err)
 	}
+	defer response.Body.Close()
 
+	bytes, err := io.ReadAll(response.Body)
 	if err != nil {
+		return nil, response.StatusCode, response.Header, fmt.Errorf("%w: %w", ErrUpstream, err)
+	}
+
+	// Success is indicated with 2xx status codes:
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		err = fmt.Errorf("%w: %s: %s", ErrUnauthorized, response.Status, string(bytes))
+	case response.StatusCode == http.StatusTooManyRequests:
+		err = fmt.Errorf("%w: %s: %s", ErrRateLimited, response.Status, string(bytes))
+	case response.StatusCode < 200 || response.StatusCode >= 300:
+		err = fmt.Errorf("%w: %s: %s", ErrUpstream, response.Status, string(bytes))
+	}
+	return bytes, response.StatusCode, response.Header, err
+}
+
+func PollutionForecastByCoordinates(ctx context.Context, loc Location, client *http.Client, settings *Settings) (*Pollution, error) {
+	var pollution Pollution
+
+	q := url.Values{}
+	q.Set("appid", settings.ApiKey)
+	q.Set("lat", fmt.Sprint(loc.Latitude))
+	q.Set("lon", fmt.Sprint(loc.Longitude))
+
+	if err := getJSON(ctx, loc, client, settings, apiURL(settings, "/data/2.5/air_pollution/forecast"), q, &pollution); err != nil {
 		return nil, err
 	}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
+	return &pollution, nil
+}
 
-		}
-	}(response.Body)
-	if bytes, err := io.ReadAll(response.Body); err != nil {
+// PollutionHistoryByCoordinates returns the hourly air pollution of a location between start and end.
+func PollutionHistoryByCoordinates(ctx context.Context, loc Location, start, end time.Time, client *http.Client, settings *Settings) (*Pollution, error) {
+	var pollution Pollution
+
+	q := url.Values{}
+	q.Set("appid", settings.ApiKey)
+	q.Set("lat", fmt.Sprint(loc.Latitude))
+	q.Set("lon", fmt.Sprint(loc.Longitude))
+	q.Set("start", fmt.Sprint(start.Unix()))
+	q.Set("end", fmt.Sprint(end.Unix()))
+
+	if err := getJSON(ctx, loc, client, settings, apiURL(settings, "/data/2.5/air_pollution/history"), q, &pollution); err != nil {
 		return nil, err
-	} else if err := json.Unmarshal(bytes, &pollution); err != nil {
-		return nil, fmt.Errorf("response: %s; error: %s", string(bytes), err.Error())
 	}
 
-	return &pollution.List[0], nil
+	return &pollution, nil
 }
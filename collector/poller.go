@@ -0,0 +1,338 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	refreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "openweather_refresh_duration_seconds",
+		Help:    "Duration of background refreshes of a location",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"location"})
+
+	refreshLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "openweather_refresh_last_success_timestamp_seconds",
+		Help: "Time of the last background refresh of a location in which every endpoint succeeded, unix, UTC",
+	}, []string{"location"})
+)
+
+func init() {
+	prometheus.MustRegister(refreshDuration, refreshLastSuccess)
+}
+
+// minRefreshInterval is the shortest interval a location is refreshed at.
+const minRefreshInterval = time.Minute
+
+// PollerOptions decide how often the poller refreshes a location.
+type PollerOptions struct {
+	// Adaptive derives the interval from the daily call budget and the calls
+	// every location needs, instead of using the cache TTL.
+	Adaptive bool
+	// Boost divides the interval while precipitation starts or stops within
+	// the hour, according to the minutely forecast. 1 or less disables it.
+	Boost int
+}
+
+// StartPoller refreshes every location in the background, each on its own
+// interval, after which scrapes only read the latest cached responses. The
+// interval is the cache TTL of the location unless options say otherwise.
+func (collector *OpenweatherCollector) StartPoller(options PollerOptions) {
+	collector.pollerOptions = options
+	collector.polling.Store(true)
+	go collector.poll()
+}
+
+// baseInterval returns the interval at which a location is refreshed.
+func (collector *OpenweatherCollector) baseInterval(state *collectorState, location Location) time.Duration {
+	interval := cacheTTL(location)
+	if collector.pollerOptions.Adaptive {
+		if budgeted := budgetInterval(state.locations, location); budgeted > 0 {
+			interval = budgeted
+		}
+	}
+	return max(interval, minRefreshInterval)
+}
+
+// refreshInterval returns the base interval of a location, boosted while
+// its precipitation is changing as far as the calls left in the budget allow.
+func (collector *OpenweatherCollector) refreshInterval(state *collectorState, location Location) time.Duration {
+	interval := collector.baseInterval(state, location)
+	if boost := collector.pollerOptions.Boost; boost > 1 && collector.precipitationChanging(location) {
+		boosted := max(interval/time.Duration(boost), minRefreshInterval, headroomInterval(state.locations, location, time.Now()))
+		interval = min(interval, boosted)
+	}
+	return interval
+}
+
+// headroomInterval returns the shortest interval at which every location
+// sharing the budget of a location can be refreshed without using up the
+// calls left before the budget resets. It is 0 without a budget.
+func headroomInterval(locations []Location, location Location, now time.Time) time.Duration {
+	budget := location.Settings.Budget
+	if budget == nil {
+		return 0
+	}
+
+	interval := func(left int, shares func(Location) bool) time.Duration {
+		if left < 0 {
+			return 0
+		}
+		calls := 0
+		for _, loc := range locations {
+			if shares(loc) {
+				calls += refreshCalls(loc.Settings)
+			}
+		}
+		return nextBudgetReset(now).Sub(now) * time.Duration(calls) / time.Duration(max(left, 1))
+	}
+
+	total, key := budget.left(location.Settings.ApiKey, now)
+	return max(
+		interval(total, func(Location) bool { return true }),
+		interval(key, func(loc Location) bool { return loc.Settings.ApiKey == location.Settings.ApiKey }),
+	)
+}
+
+// budgetInterval spreads the daily budget of a location evenly over the day,
+// across every location sharing the budget. It is 0 without a daily budget.
+// A monthly budget counts as a daily budget of a 31st of it.
+func budgetInterval(locations []Location, location Location) time.Duration {
+	budget := location.Settings.Budget
+	if budget == nil {
+		return 0
+	}
+
+	interval := func(daily, monthly int, shares func(Location) bool) time.Duration {
+		if monthly > 0 && (daily == 0 || monthly/31 < daily) {
+			daily = max(monthly/31, 1)
+		}
+		if daily == 0 {
+			return 0
+		}
+		calls := 0
+		for _, loc := range locations {
+			if shares(loc) {
+				calls += refreshCalls(loc.Settings)
+				daily -= dailyCalls(loc.Settings)
+			}
+		}
+		return 24 * time.Hour * time.Duration(calls) / time.Duration(max(daily, 1))
+	}
+
+	return max(
+		interval(budget.Daily, budget.Monthly, func(Location) bool { return true }),
+		interval(budget.KeyDaily, budget.KeyMonthly, func(loc Location) bool { return loc.Settings.ApiKey == location.Settings.ApiKey }),
+	)
+}
+
+// refreshCalls returns the number of API calls a refresh of a location makes.
+func refreshCalls(settings *Settings) int {
+	calls := 0
+	if settings.EnableOneCall || settings.EnableMinutely || settings.EnableHourly || settings.EnableDaily || settings.EnableAlerts {
+		calls++
+	}
+	if settings.EnableDaySummary {
+		calls++
+	}
+	if settings.EnablePol {
+		calls++
+	}
+	if settings.EnablePolForecast {
+		calls++
+	}
+	return calls
+}
+
+// dailyCalls returns the number of API calls a location makes once a day,
+// besides its refreshes, for the summary of yesterday.
+func dailyCalls(settings *Settings) int {
+	if settings.EnableDaySummary {
+		return 1
+	}
+	return 0
+}
+
+// precipitationChanging reports whether the cached minutely forecast of a
+// location has precipitation starting or stopping within the hour.
+func (collector *OpenweatherCollector) precipitationChanging(location Location) bool {
+	val, err := collector.Cache.Get(cacheKey(location, "onecall"))
+	if err != nil {
+		return false
+	}
+	minutely := upcomingMinutely(val.(cachedResponse).Data.(*OneCallData))
+	for _, m := range minutely {
+		if (m.Precipitation > 0) != (minutely[0].Precipitation > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextRefresh returns when to refresh a location next, at least half an
+// interval from now. Refreshes are aligned to a phase derived from the location
+// name, so the refreshes of all locations are spread evenly over the interval.
+func nextRefresh(name string, now time.Time, interval time.Duration) time.Time {
+	next := now.Truncate(interval).Add(refreshPhase(name, interval))
+	for next.Sub(now) < interval/2 {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// startupWindow is the time over which the locations without fresh cached
+// responses are first refreshed after a start.
+const startupWindow = 30 * time.Second
+
+// firstRefresh returns when to refresh a location for the first time after a
+// start. Responses loaded from the disk cache are refreshed when they would
+// have been without the restart. Otherwise the location is refreshed within
+// the startup window, at an offset derived from its name so the locations do
+// not all refresh at once. Later refreshes are aligned to the phase of the
+// location.
+func (collector *OpenweatherCollector) firstRefresh(state *collectorState, location Location, now time.Time) time.Time {
+	interval := collector.refreshInterval(state, location)
+	if fetched, ok := collector.cachedSince(location); ok {
+		if next := nextRefresh(location.Location, fetched, interval); next.After(now) {
+			return next
+		}
+	}
+	return now.Add(refreshPhase(location.Location, min(interval, startupWindow)))
+}
+
+// cachedSince returns when the latest cached response of a location was
+// fetched, or false if none is cached.
+func (collector *OpenweatherCollector) cachedSince(location Location) (time.Time, bool) {
+	var latest time.Time
+	for _, key := range collector.Cache.GetKeys() {
+		if !strings.HasPrefix(key, locationKey(location)+":") {
+			continue
+		}
+		val, err := collector.Cache.Get(key)
+		if err != nil {
+			continue
+		}
+		if fetched := val.(cachedResponse).Fetched; fetched.After(latest) {
+			latest = fetched
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// refreshPhase derives the offset of the refreshes of a location within the
+// interval from its name.
+func refreshPhase(name string, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+func (collector *OpenweatherCollector) poll() {
+	var mu sync.Mutex
+	next := make(map[string]time.Time)
+	polled := make(map[string]Location)
+	inFlight := make(map[string]bool)
+	started := false
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := time.Now(); ; now = <-ticker.C {
+		// Load the state on every tick, to pick up reloaded locations.
+		state := collector.state.Load()
+		current := make(map[string]bool)
+
+		mu.Lock()
+		for _, location := range state.locations {
+			current[location.Location] = true
+			if prev, ok := polled[location.Location]; ok && locationChanged(prev, location) {
+				// Reload dropped the cached responses, refresh right away.
+				next[location.Location] = now
+			}
+			if _, ok := next[location.Location]; !ok {
+				// Stagger the locations at start, refresh added ones right away.
+				next[location.Location] = now
+				if !started {
+					next[location.Location] = collector.firstRefresh(state, location, now)
+				}
+			}
+			polled[location.Location] = location
+			if inFlight[location.Location] || now.Before(next[location.Location]) {
+				continue
+			}
+
+			inFlight[location.Location] = true
+			go func() {
+				err := collector.refresh(state, location)
+
+				mu.Lock()
+				defer mu.Unlock()
+				inFlight[location.Location] = false
+				from := time.Now()
+				if errors.Is(err, ErrBudgetExhausted) {
+					// No calls are left until the budget resets.
+					from = nextBudgetReset(from)
+				}
+				next[location.Location] = nextRefresh(location.Location, from, collector.refreshInterval(state, location))
+			}()
+		}
+
+		for name := range polled {
+			if !current[name] && !inFlight[name] {
+				delete(next, name)
+				delete(polled, name)
+				refreshDuration.DeleteLabelValues(name)
+				refreshLastSuccess.DeleteLabelValues(name)
+			}
+		}
+		mu.Unlock()
+		started = true
+	}
+}
+
+// refresh calls the API for every enabled endpoint of a location, discarding
+// the metrics, to replace its cached responses.
+func (collector *OpenweatherCollector) refresh(state *collectorState, location Location) error {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+
+	start := time.Now()
+	err := collector.collectLocation(context.Background(), state, location, fetchAlways, ch)
+	refreshDuration.WithLabelValues(location.Location).Observe(time.Since(start).Seconds())
+
+	close(ch)
+	<-done
+
+	if err != nil {
+		log.Infof("Refreshing %s failed: %s", location.Location, err.Error())
+		return err
+	}
+	refreshLastSuccess.WithLabelValues(location.Location).SetToCurrentTime()
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recording is the file of a recorded response.
+type recording struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Recorded time.Time   `json:"recorded"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header,omitempty"`
+	// Body holds a JSON response as is, and Text any other response.
+	Body json.RawMessage `json:"body,omitempty"`
+	Text string          `json:"text,omitempty"`
+}
+
+// recordedHeaders are the response headers the exporter reads.
+var recordedHeaders = []string{"Content-Type", "Retry-After"}
+
+// timeParams select the time of historical requests. A replay falls back to
+// a recording of another time, so a day summary recorded yesterday is served
+// for today.
+var timeParams = []string{"dt", "date", "start", "end"}
+
+// redact removes the API key from a URL.
+func redact(u *url.URL) *url.URL {
+	redacted := *u
+	q := redacted.Query()
+	q.Del("appid")
+	redacted.RawQuery = q.Encode()
+	return &redacted
+}
+
+// recordingKey identifies the request for u by its path and sorted query, so
+// recordings replay against any base URL and API key. The ignored query
+// parameters are left out.
+func recordingKey(u *url.URL, ignore ...string) string {
+	q := redact(u).Query()
+	for _, param := range ignore {
+		q.Del(param)
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// recordingFile names the recording of u after its path and a hash of its
+// key, such as data_3.0_onecall_1a2b3c4d.json.
+func recordingFile(u *url.URL) string {
+	sum := sha256.Sum256([]byte(recordingKey(u)))
+	name := strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", "_")
+	return name + "_" + hex.EncodeToString(sum[:4]) + ".json"
+}
+
+// recordTransport writes every response to a file in a directory.
+type recordTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+func newRecordTransport(next http.RoundTripper, dir string) (*recordTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create record directory: %w", err)
+	}
+	return &recordTransport{next: next, dir: dir}, nil
+}
+
+func (t *recordTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := recording{
+		Method:   r.Method,
+		URL:      redact(r.URL).String(),
+		Recorded: time.Now().UTC(),
+		Status:   resp.StatusCode,
+		Header:   http.Header{},
+	}
+	for _, name := range recordedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			rec.Header.Set(name, value)
+		}
+	}
+	if json.Valid(body) {
+		rec.Body = body
+	} else {
+		rec.Text = string(body)
+	}
+
+	// Keep query strings readable, without escaping & as \u0026.
+	file := recordingFile(r.URL)
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(rec); err != nil {
+		log.Errorf("Could not encode recorded response %s: %s", file, err.Error())
+		return resp, nil
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, file), data.Bytes(), 0o644); err != nil {
+		log.Errorf("Could not write recorded response %s: %s", file, err.Error())
+	}
+	return resp, nil
+}
+
+// replayTransport answers every request from the recordings in a directory,
+// without calling the API.
+type replayTransport struct {
+	// exact holds the recordings by key, and timeless by key without the
+	// time parameters.
+	exact, timeless map[string]*recording
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read replay directory: %w", err)
+	}
+
+	t := &replayTransport{exact: map[string]*recording{}, timeless: map[string]*recording{}}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read recorded response %s: %w", file.Name(), err)
+		}
+		rec := &recording{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, fmt.Errorf("could not decode recorded response %s: %w", file.Name(), err)
+		}
+		u, err := url.Parse(rec.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL in recorded response %s: %w", file.Name(), err)
+		}
+		t.exact[recordingKey(u)] = rec
+		t.timeless[recordingKey(u, timeParams...)] = rec
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec, ok := t.exact[recordingKey(r.URL)]
+	if !ok {
+		rec, ok = t.timeless[recordingKey(r.URL, timeParams...)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no recorded response for %s", redact(r.URL))
+	}
+
+	body := []byte(rec.Text)
+	if len(rec.Body) > 0 {
+		body = rec.Body
+	}
+	header := rec.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
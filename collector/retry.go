@@ -0,0 +1,72 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides how often and how long to wait before a failed API call is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls made at most, retrying is disabled below 2.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled for every next retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait before a retry. A Retry-After beyond it is not waited for.
+	MaxBackoff time.Duration
+}
+
+// retryable reports whether a call that failed with status, 0 if there was
+// no response, might succeed when retried.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff returns the wait before retrying a call that failed for the given
+// attempt, starting at 1, with a random jitter of up to half the wait. ok is
+// false if the server asked to wait longer than MaxBackoff.
+func (p RetryPolicy) backoff(attempt int, status int, header http.Header) (wait time.Duration, ok bool) {
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		if after, found := retryAfter(header.Get("Retry-After")); found {
+			return after, after <= p.MaxBackoff
+		}
+	}
+
+	wait = p.InitialBackoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, p.MaxBackoff)
+	if wait > 1 {
+		wait = wait/2 + rand.N(wait/2)
+	}
+	return wait, true
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
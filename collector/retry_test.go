@@ -0,0 +1,110 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{0, true},
+		{http.StatusOK, false},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.status); got != tt.want {
+			t.Errorf("retryable(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	retryAfter := func(value string) http.Header {
+		return http.Header{"Retry-After": []string{value}}
+	}
+
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempt  int
+		status   int
+		header   http.Header
+		min, max time.Duration
+		ok       bool
+	}{
+		{"first retry", policy, 1, http.StatusInternalServerError, nil, 500 * time.Millisecond, time.Second, true},
+		{"doubled", policy, 3, 0, nil, 2 * time.Second, 4 * time.Second, true},
+		{"capped", policy, 10, http.StatusBadGateway, nil, 5 * time.Second, 10 * time.Second, true},
+		{"no backoff", RetryPolicy{MaxAttempts: 3}, 2, 0, nil, 0, 0, true},
+		{"retry after", policy, 1, http.StatusTooManyRequests, retryAfter("5"), 5 * time.Second, 5 * time.Second, true},
+		{"retry after unavailable", policy, 4, http.StatusServiceUnavailable, retryAfter("0"), 0, 0, true},
+		{"retry after too long", policy, 1, http.StatusTooManyRequests, retryAfter("30"), 30 * time.Second, 30 * time.Second, false},
+		{"retry after ignored", policy, 1, http.StatusInternalServerError, retryAfter("30"), 500 * time.Millisecond, time.Second, true},
+		{"invalid retry after", policy, 1, http.StatusTooManyRequests, retryAfter("soon"), 500 * time.Millisecond, time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The jitter is random, so try a few times.
+			for i := 0; i < 20; i++ {
+				wait, ok := tt.policy.backoff(tt.attempt, tt.status, tt.header)
+				if ok != tt.ok {
+					t.Fatalf("backoff() ok = %v, want %v", ok, tt.ok)
+				}
+				if wait < tt.min || wait > tt.max {
+					t.Fatalf("backoff() = %s, want between %s and %s", wait, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+		ok       bool
+	}{
+		{"missing", "", 0, 0, false},
+		{"seconds", "120", 2 * time.Minute, 2 * time.Minute, true},
+		{"zero", "0", 0, 0, true},
+		{"negative", "-1", 0, 0, false},
+		{"invalid", "soon", 0, 0, false},
+		{"date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute, true},
+		{"past date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfter(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("retryAfter(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+			}
+			if got < tt.min || got > tt.max {
+				t.Errorf("retryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -36,13 +36,18 @@ type Weather struct {
 	Icon        string `json:"icon"`
 }
 
-// OneCallData the API should be called with exclude=minutely,hourly,daily,alerts
+// OneCallData the API should be called with exclude set to every block that is
+// not decoded, see https://openweathermap.org/api/one-call-3#parameter
 type OneCallData struct {
-	Latitude       float64            `json:"lat"`
-	Longitude      float64            `json:"lon"`
-	Timezone       string             `json:"timezone"`
-	TimezoneOffset int                `json:"timezone_offset"`
-	Current        OneCallCurrentData `json:"current,omitempty"`
+	Latitude       float64               `json:"lat"`
+	Longitude      float64               `json:"lon"`
+	Timezone       string                `json:"timezone"`
+	TimezoneOffset int                   `json:"timezone_offset"`
+	Current        OneCallCurrentData    `json:"current,omitempty"`
+	Minutely       []OneCallMinutelyData `json:"minutely,omitempty"`
+	Hourly         []OneCallHourlyData   `json:"hourly,omitempty"`
+	Daily          []OneCallDailyData    `json:"daily,omitempty"`
+	Alerts         []OneCallAlert        `json:"alerts,omitempty"`
 }
 
 type OneCallCurrentData struct {
@@ -65,6 +70,129 @@ type OneCallCurrentData struct {
 	Weather    []Weather `json:"weather"`
 }
 
+// OneCallTimeMachineData https://openweathermap.org/api/one-call-3#history
+type OneCallTimeMachineData struct {
+	Latitude       float64              `json:"lat"`
+	Longitude      float64              `json:"lon"`
+	Timezone       string               `json:"timezone"`
+	TimezoneOffset int                  `json:"timezone_offset"`
+	Data           []OneCallCurrentData `json:"data"`
+}
+
+// OneCallMinutelyData https://openweathermap.org/api/one-call-3#minutely
+type OneCallMinutelyData struct {
+	Dt            int     `json:"dt"`
+	Precipitation float64 `json:"precipitation"`
+}
+
+// OneCallHourlyData https://openweathermap.org/api/one-call-3#hourly
+type OneCallHourlyData struct {
+	Dt         int       `json:"dt"`
+	Temp       float64   `json:"temp"`
+	FeelsLike  float64   `json:"feels_like"`
+	Pressure   int       `json:"pressure"`
+	Humidity   int       `json:"humidity"`
+	DewPoint   float64   `json:"dew_point"`
+	UVI        float64   `json:"uvi"`
+	Clouds     int       `json:"clouds"`
+	Visibility int       `json:"visibility"`
+	WindSpeed  float64   `json:"wind_speed"`
+	WindGust   float64   `json:"wind_gust,omitempty"`
+	WindDeg    float64   `json:"wind_deg"`
+	Pop        float64   `json:"pop"`
+	Rain       Rain      `json:"rain,omitempty"`
+	Snow       Snow      `json:"snow,omitempty"`
+	Weather    []Weather `json:"weather"`
+}
+
+// OneCallDailyData https://openweathermap.org/api/one-call-3#daily
+type OneCallDailyData struct {
+	Dt        int     `json:"dt"`
+	Sunrise   int     `json:"sunrise"`
+	Sunset    int     `json:"sunset"`
+	Moonrise  int     `json:"moonrise"`
+	Moonset   int     `json:"moonset"`
+	MoonPhase float64 `json:"moon_phase"`
+	Summary   string  `json:"summary"`
+	Temp      struct {
+		Day   float64 `json:"day"`
+		Min   float64 `json:"min"`
+		Max   float64 `json:"max"`
+		Night float64 `json:"night"`
+		Eve   float64 `json:"eve"`
+		Morn  float64 `json:"morn"`
+	} `json:"temp"`
+	FeelsLike struct {
+		Day   float64 `json:"day"`
+		Night float64 `json:"night"`
+		Eve   float64 `json:"eve"`
+		Morn  float64 `json:"morn"`
+	} `json:"feels_like"`
+	Pressure  int       `json:"pressure"`
+	Humidity  int       `json:"humidity"`
+	DewPoint  float64   `json:"dew_point"`
+	WindSpeed float64   `json:"wind_speed"`
+	WindGust  float64   `json:"wind_gust,omitempty"`
+	WindDeg   float64   `json:"wind_deg"`
+	Clouds    int       `json:"clouds"`
+	UVI       float64   `json:"uvi"`
+	Pop       float64   `json:"pop"`
+	Rain      float64   `json:"rain,omitempty"`
+	Snow      float64   `json:"snow,omitempty"`
+	Weather   []Weather `json:"weather"`
+}
+
+// OneCallAlert https://openweathermap.org/api/one-call-3#alerts
+type OneCallAlert struct {
+	SenderName  string   `json:"sender_name"`
+	Event       string   `json:"event"`
+	Start       int      `json:"start"`
+	End         int      `json:"end"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// DaySummaryData https://openweathermap.org/api/one-call-3#history_daily_aggregation
+type DaySummaryData struct {
+	Latitude   float64 `json:"lat"`
+	Longitude  float64 `json:"lon"`
+	Tz         string  `json:"tz"`
+	Date       string  `json:"date"`
+	Units      string  `json:"units"`
+	CloudCover struct {
+		Afternoon float64 `json:"afternoon"`
+	} `json:"cloud_cover"`
+	Humidity struct {
+		Afternoon float64 `json:"afternoon"`
+	} `json:"humidity"`
+	Precipitation struct {
+		Total float64 `json:"total"`
+	} `json:"precipitation"`
+	Temperature struct {
+		Min       float64 `json:"min"`
+		Max       float64 `json:"max"`
+		Afternoon float64 `json:"afternoon"`
+		Night     float64 `json:"night"`
+		Evening   float64 `json:"evening"`
+		Morning   float64 `json:"morning"`
+	} `json:"temperature"`
+	Pressure struct {
+		Afternoon float64 `json:"afternoon"`
+	} `json:"pressure"`
+	Wind struct {
+		Max struct {
+			Speed     float64 `json:"speed"`
+			Direction float64 `json:"direction"`
+		} `json:"max"`
+	} `json:"wind"`
+}
+
+// DaySummaries holds the aggregates for the previous and the current local day.
+type DaySummaries struct {
+	Yesterday DaySummaryData
+	Today     DaySummaryData
+}
+
 // Pollution API: https://openweathermap.org/api/air-pollution#current
 
 type Pollution struct {
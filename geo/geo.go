@@ -14,10 +14,25 @@
 package geo
 
 import (
+	"fmt"
+	"net/http"
+
 	log "github.com/sirupsen/logrus"
 )
 
-var n = Nominatim{}
+// Found locations are cached for a day, so reloading the configuration only
+// looks up new locations.
+var n = Nominatim{UseCache: true}
+
+// SetClient makes the HTTP requests of lookups with client.
+func SetClient(client *http.Client) {
+	n.Client = client
+}
+
+// SetBaseURL looks up locations with the Nominatim API at url.
+func SetBaseURL(url string) {
+	n.BaseURL = url
+}
 
 func GetCoords(city string) (float64, float64, error) {
 	log.Info("Looking up: " + city)
@@ -31,12 +46,11 @@ func GetCoords(city string) (float64, float64, error) {
 		return 0, 0, err
 	}
 
-	if results[0].Lat != 0 {
-		log.Infof("Latitude: %f Longitude: %f for %s found", results[0].Lat, results[0].Lng, results[0].DisplayName)
-		return results[0].Lat, results[0].Lng, nil
-	} else {
-		log.Fatalf("Could not get location data for %s", city)
-		return 0, 0, err
+	if len(results) == 0 || results[0].Lat == 0 {
+		return 0, 0, fmt.Errorf("could not get location data for %s", city)
 	}
 
+	log.Infof("Latitude: %f Longitude: %f for %s found", results[0].Lat, results[0].Lng, results[0].DisplayName)
+	return results[0].Lat, results[0].Lng, nil
+
 }
@@ -11,18 +11,38 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v2"
 )
 
 var lettersregex = regexp.MustCompile("([A-Za-z ]+)")
-var cache = map[string][]SearchResult{}
-var cachelock = sync.Mutex{}
+
+// cache keeps found locations for a day, and at most cacheSize of them, so
+// free-text lookups don't grow it without limit.
+var cache = newCache()
+
+const (
+	cacheTTL  = 24 * time.Hour
+	cacheSize = 1000
+)
+
+func newCache() *ttlcache.Cache {
+	c := ttlcache.NewCache()
+	_ = c.SetTTL(cacheTTL)
+	c.SetCacheSizeLimit(cacheSize)
+	c.SkipTTLExtensionOnHit(true)
+	return c
+}
+
 var reqlock = sync.Mutex{}
 
 type Nominatim struct {
-	BaseURL           string // Use another than default nominatim base url
-	FormatHouseNumber bool   // Remove all letters from house number
-	UseCache          bool   // Use caching for same requests
-	Sync              bool   // Only 1 request at the same time
+	BaseURL           string       // Use another than default nominatim base url
+	FormatHouseNumber bool         // Remove all letters from house number
+	UseCache          bool         // Use caching for same requests
+	Sync              bool         // Only 1 request at the same time
+	Client            *http.Client // Use another than the default HTTP client
 }
 
 type SearchParameters struct {
@@ -94,7 +114,7 @@ func (n *Nominatim) Search(p SearchParameters) ([]SearchResult, error) {
 		return []SearchResult{}, err
 	}
 	// Set path
-	nurl.RawPath = "/search"
+	nurl = nurl.JoinPath("search")
 	// Build query
 	q := nurl.Query()
 	// Basics
@@ -146,12 +166,8 @@ func (n *Nominatim) Search(p SearchParameters) ([]SearchResult, error) {
 	nurl.RawQuery = q.Encode()
 	// Check cache
 	if n.UseCache {
-		cachelock.Lock()
-		if res, ok := cache[nurl.String()]; ok {
-			cachelock.Unlock()
-			return res, nil
-		} else {
-			cachelock.Unlock()
+		if res, err := cache.Get(nurl.String()); err == nil {
+			return res.([]SearchResult), nil
 		}
 	}
 	// Make request
@@ -163,7 +179,11 @@ func (n *Nominatim) Search(p SearchParameters) ([]SearchResult, error) {
 	// Set User Agent
 	req.Header.Set("User-Agent", "Openweather_Exporter")
 
-	resp, err := http.DefaultClient.Do(req)
+	client := http.DefaultClient
+	if n.Client != nil {
+		client = n.Client
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return []SearchResult{}, err
 	}
@@ -202,11 +222,9 @@ func (n *Nominatim) Search(p SearchParameters) ([]SearchResult, error) {
 			results[i].Address.HouseNumber = lettersregex.ReplaceAllString(result.Address.HouseNumber, "")
 		}
 	}
-	// Save cache
-	if n.UseCache {
-		cachelock.Lock()
-		cache[nurl.String()] = results
-		cachelock.Unlock()
+	// Save cache, but look up unknown locations again
+	if n.UseCache && len(results) > 0 {
+		_ = cache.Set(nurl.String(), results)
 	}
 	// Return
 	return results, nil
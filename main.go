@@ -14,16 +14,26 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jellydator/ttlcache/v2"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/billykwooten/openweather-exporter/collector"
+	"github.com/billykwooten/openweather-exporter/geo"
+	"github.com/billykwooten/openweather-exporter/mock"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -32,18 +42,81 @@ var (
 	// Default App Flags
 	app         = kingpin.New("openweather-exporter", "Openweather Exporter for Openweather API").Author("Billy Wooten")
 	addr        = app.Flag("listen-address", "HTTP port to listen on. (Default 9091)").Envar("OW_LISTEN_ADDRESS").Default(":9091").String()
-	apiKey      = app.Flag("apikey", "Openweather API Key").Envar("OW_APIKEY").Required().String()
+	apiKey      = app.Flag("apikey", "Openweather API Key").Envar("OW_APIKEY").String()
 	city        = app.Flag("city", "City for Openweather to gather metrics from.").Envar("OW_CITY").Default("New York, NY").String()
 	degreesUnit = app.Flag("degrees-unit", "The base unit for temperature output. Fahrenheit or Celsius. (Default: F)").Envar("OW_DEGREES_UNIT").Default("F").String()
 	language    = app.Flag("language", "The language for metric output. (Default: EN)").Envar("OW_LANGUAGE").Default("EN").String()
+	apiURL      = app.Flag("api-url", "Base URL of the Openweather API. (Default: https://api.openweathermap.org)").Envar("OW_API_URL").Default(collector.DefaultBaseURL).String()
+	geoURL      = app.Flag("nominatim-url", "Base URL of the Nominatim API to look up cities with. (Default: https://nominatim.openstreetmap.org)").Envar("OW_NOMINATIM_URL").Default("https://nominatim.openstreetmap.org").String()
+	httpTimeout = app.Flag("http-timeout", "Timeout of HTTP requests. (Default: 30s)").Envar("OW_HTTP_TIMEOUT").Default("30s").Duration()
+	httpProxy   = app.Flag("http-proxy", "Proxy URL for HTTP requests, taken from HTTPS_PROXY and NO_PROXY if not set.").Envar("OW_HTTP_PROXY").String()
+	httpCAFile  = app.Flag("http-ca-file", "PEM bundle of certificate authorities to trust in addition to the system ones.").Envar("OW_HTTP_CA_FILE").String()
+	userAgent   = app.Flag("user-agent", "User-Agent sent with HTTP requests.").Envar("OW_USER_AGENT").String()
+	recordDir   = app.Flag("record-dir", "Directory to write every Openweather and Nominatim response to, without the API key.").Envar("OW_RECORD_DIR").String()
+	replayDir   = app.Flag("replay-dir", "Directory of recorded responses to serve instead of calling the Openweather and Nominatim APIs.").Envar("OW_REPLAY_DIR").String()
 	cacheTTL    = app.Flag("cache-ttl", "Cache time-to-live in seconds. (Default: 300)").Envar("OW_CACHE_TTL").Default("300").String()
+	cacheDir    = app.Flag("cache-dir", "Directory to keep cached responses in across restarts, kept in memory only if not set.").Envar("OW_CACHE_DIR").String()
+	maxStale    = app.Flag("cache-max-staleness", "How long after the cache TTL to keep serving cached data while the API fails, 0 to disable. (Default: 0s)").Envar("OW_CACHE_MAX_STALENESS").Default("0s").Duration()
+	concurrency = app.Flag("concurrency", "Number of API calls made at once. (Default: 4)").Envar("OW_CONCURRENCY").Default("4").Int()
+	retryMax    = app.Flag("retry-max-attempts", "Number of calls made at most for an API request, 1 disables retrying. (Default: 3)").Envar("OW_RETRY_MAX_ATTEMPTS").Default("3").Int()
+	retryWait   = app.Flag("retry-initial-backoff", "Wait before retrying a failed API call, doubled for every next retry. (Default: 1s)").Envar("OW_RETRY_INITIAL_BACKOFF").Default("1s").Duration()
+	retryCap    = app.Flag("retry-max-backoff", "Longest wait before retrying a failed API call, also for a Retry-After. (Default: 10s)").Envar("OW_RETRY_MAX_BACKOFF").Default("10s").Duration()
+	budgetDaily = app.Flag("budget-daily", "Most API calls per UTC day, 0 for unlimited, counted across restarts with --cache-dir. (Default: 0)").Envar("OW_BUDGET_DAILY").Default("0").Int()
+	budgetMonth = app.Flag("budget-monthly", "Most API calls per UTC month, 0 for unlimited, counted across restarts with --cache-dir. (Default: 0)").Envar("OW_BUDGET_MONTHLY").Default("0").Int()
+	keyDaily    = app.Flag("budget-key-daily", "Most API calls per UTC day for each API key, 0 for unlimited, counted across restarts with --cache-dir. (Default: 0)").Envar("OW_BUDGET_KEY_DAILY").Default("0").Int()
+	keyMonthly  = app.Flag("budget-key-monthly", "Most API calls per UTC month for each API key, 0 for unlimited, counted across restarts with --cache-dir. (Default: 0)").Envar("OW_BUDGET_KEY_MONTHLY").Default("0").Int()
+	poller      = app.Flag("poller", "Refresh locations in the background every cache TTL instead of during scrapes. (Default: false)").Envar("OW_POLLER").Default("false").Bool()
+	adaptive    = app.Flag("adaptive-refresh", "Refresh locations as often as the daily API call budget allows instead of every cache TTL, needs --poller. (Default: false)").Envar("OW_ADAPTIVE_REFRESH").Default("false").Bool()
+	boost       = app.Flag("refresh-boost", "Refresh a location this many times as often while precipitation starts or stops within the hour, needs --poller and --enable-minutely. (Default: 1)").Envar("OW_REFRESH_BOOST").Default("1").Int()
+	configFile  = app.Flag("config.file", "YAML file listing locations with their own settings, used instead of --city.").Envar("OW_CONFIG_FILE").String()
 
 	// Extra App Flags
-	enablePol = app.Flag("enable-pol", "Enable Pollution Metrics. (Default: false)").Envar("OW_ENABLE_POL").Default("false").Bool()
+	enablePol      = app.Flag("enable-pol", "Enable Pollution Metrics. (Default: false)").Envar("OW_ENABLE_POL").Default("false").Bool()
+	enablePolFc    = app.Flag("enable-pol-forecast", "Enable Pollution Forecast Metrics. (Default: false)").Envar("OW_ENABLE_POL_FORECAST").Default("false").Bool()
+	polFcHorizons  = app.Flag("pol-forecast-horizons", "Comma separated hours ahead to export pollution forecasts for, 0-95. (Default: 12,24,48)").Envar("OW_POL_FORECAST_HORIZONS").Default("12,24,48").String()
+	enableMinutely = app.Flag("enable-minutely", "Enable Minutely Precipitation Nowcast Metrics. (Default: false)").Envar("OW_ENABLE_MINUTELY").Default("false").Bool()
+	enableHourly   = app.Flag("enable-hourly", "Enable Hourly Forecast Metrics. (Default: false)").Envar("OW_ENABLE_HOURLY").Default("false").Bool()
+	hourlyHorizons = app.Flag("hourly-horizons", "Comma separated hours ahead to export hourly forecasts for, 0-47. (Default: 3,6,12)").Envar("OW_HOURLY_HORIZONS").Default("3,6,12").String()
+	enableDaily    = app.Flag("enable-daily", "Enable Daily Forecast Metrics. (Default: false)").Envar("OW_ENABLE_DAILY").Default("false").Bool()
+	dailyDays      = app.Flag("daily-days", "Number of days, starting with today, to export daily forecasts for, 1-8. (Default: 8)").Envar("OW_DAILY_DAYS").Default("8").Int()
+	enableAlerts   = app.Flag("enable-alerts", "Enable Weather Alert Metrics. (Default: false)").Envar("OW_ENABLE_ALERTS").Default("false").Bool()
+	enableDaySum   = app.Flag("enable-day-summary", "Enable Daily Aggregation Metrics for yesterday and today. (Default: false)").Envar("OW_ENABLE_DAY_SUMMARY").Default("false").Bool()
 )
 
+var (
+	// Commands
+	serveCmd = app.Command("serve", "Serve metrics over HTTP. (Default)").Default()
+
+	backfillCmd    = app.Command("backfill", "Write the weather history of each location as OpenMetrics for promtool tsdb create-blocks-from openmetrics.")
+	backfillFrom   = backfillCmd.Flag("from", "First day to backfill, YYYY-MM-DD in UTC. (Default: 30 days before --to)").String()
+	backfillTo     = backfillCmd.Flag("to", "Day to backfill up to, exclusive, YYYY-MM-DD in UTC. (Default: now)").String()
+	backfillSource = backfillCmd.Flag("source", "Data to backfill, onecall for weather or pollution for hourly air pollution. (Default: onecall)").Default("onecall").Enum("onecall", "pollution")
+	backfillStep   = backfillCmd.Flag("step", "Interval between historical weather samples, each one is an API call per location. (Default: 1h)").Default("1h").Duration()
+	backfillOutput = backfillCmd.Flag("output", "File to write OpenMetrics to, - for stdout. (Default: -)").Default("-").String()
+
+	mockCmd      = app.Command("mock-server", "Serve synthetic Openweather and Nominatim API responses for development and testing.")
+	mockAddr     = mockCmd.Flag("address", "HTTP port to serve the mock API on. (Default: :9092)").Default(":9092").String()
+	mockFixtures = mockCmd.Flag("fixtures", "Directory of JSON responses to serve instead of synthetic ones, named after the API path, like onecall.json.").String()
+)
+
+// parseHorizons parses a comma separated list of forecast horizons in hours.
+func parseHorizons(horizons string, max int) ([]int, error) {
+	var res []int
+	for _, h := range strings.Split(horizons, ",") {
+		horizon, err := strconv.Atoi(strings.TrimSpace(h))
+		if err != nil {
+			return nil, err
+		}
+		if horizon < 0 || horizon > max {
+			return nil, fmt.Errorf("horizon %d out of range 0-%d", horizon, max)
+		}
+		res = append(res, horizon)
+	}
+	return res, nil
+}
+
 func main() {
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	// Setup better logging
 	formatter := &log.TextFormatter{
@@ -52,35 +125,316 @@ func main() {
 
 	log.SetFormatter(formatter)
 
-	// Create a new instance of the weatherCollector with caching and
-	// register it with the prometheus client.
-	log.Infof("Cache Time set to: %s", *cacheTTL+" seconds")
-	cache := ttlcache.NewCache()
+	if command == mockCmd.FullCommand() {
+		log.Info("Serving mock API on ", *mockAddr)
+		log.Fatal(http.ListenAndServe(*mockAddr, mock.NewServer(*mockFixtures)))
+	}
+
+	horizons, err := parseHorizons(*hourlyHorizons, 47)
+	if err != nil {
+		log.Fatal("Invalid hourly horizons: ", err)
+	}
+
+	polHorizons, err := parseHorizons(*polFcHorizons, 95)
+	if err != nil {
+		log.Fatal("Invalid pollution forecast horizons: ", err)
+	}
+
+	if *dailyDays < 1 || *dailyDays > 8 {
+		log.Fatal("Invalid daily days: ", *dailyDays)
+	}
+
 	ttl, err := strconv.ParseUint(*cacheTTL, 10, 64)
 	if err != nil {
 		log.Fatal("Invalid TTL value: ", err)
 	}
-	err = cache.SetTTL(time.Duration(ttl) * time.Second)
+
+	client, err := collector.NewHTTPClient(collector.HTTPOptions{
+		Timeout: *httpTimeout, ProxyURL: *httpProxy, CAFile: *httpCAFile, UserAgent: *userAgent,
+		RecordDir: *recordDir, ReplayDir: *replayDir,
+	})
+	if err != nil {
+		log.Fatal("Invalid HTTP options: ", err)
+	}
+	geo.SetClient(client)
+	geo.SetBaseURL(strings.TrimSuffix(*geoURL, "/"))
+
+	var diskCache *collector.DiskCache
+	if *cacheDir != "" {
+		diskCache, err = collector.NewDiskCache(*cacheDir)
+		if err != nil {
+			log.Fatal("Invalid cache directory: ", err)
+		}
+	}
+
+	// Without a limit, calls are not counted and responses are cached as
+	// long as the cache TTL and staleness allow.
+	var budget *collector.Budget
+	if *budgetDaily > 0 || *budgetMonth > 0 || *keyDaily > 0 || *keyMonthly > 0 {
+		budget = collector.NewBudget(*budgetDaily, *budgetMonth, *keyDaily, *keyMonthly)
+	}
+	if budget != nil && diskCache != nil {
+		// Keep counting calls across restarts, next to the cached responses.
+		if err := budget.Persist(filepath.Join(*cacheDir, "budget.state")); err != nil {
+			log.Fatal("Invalid budget file: ", err)
+		}
+	}
+
+	settings := collector.Settings{
+		DegreesUnit: *degreesUnit, Language: *language, ApiKey: *apiKey, EnableOneCall: true, EnablePol: *enablePol,
+		EnableMinutely: *enableMinutely, EnableHourly: *enableHourly, HourlyHorizons: horizons,
+		EnableDaily: *enableDaily, DailyDays: *dailyDays, EnableAlerts: *enableAlerts,
+		EnableDaySummary: *enableDaySum, EnablePolForecast: *enablePolFc, PolForecastHorizons: polHorizons,
+		CacheTTL: time.Duration(ttl) * time.Second, MaxStaleness: *maxStale,
+		Retry:       collector.RetryPolicy{MaxAttempts: *retryMax, InitialBackoff: *retryWait, MaxBackoff: *retryCap},
+		Budget:      budget,
+		DiskCache:   diskCache,
+		Concurrency: *concurrency,
+		BaseURL:     strings.TrimSuffix(*apiURL, "/"),
+		HTTPClient:  client,
+	}
+
+	locations, err := loadLocations(&settings)
+	if errors.Is(err, collector.ErrGeocode) {
+		// Serve the other locations rather than failing on a lookup.
+		log.Error("Skipping locations: ", err)
+	} else if err != nil {
+		log.Fatal("Invalid locations: ", err)
+	}
+
+	switch command {
+	case backfillCmd.FullCommand():
+		backfill(&settings, locations)
+	default:
+		serve(&settings, locations)
+	}
+}
+
+// loadLocations returns the locations of the configuration file if there is
+// one, or else the locations given with --city.
+func loadLocations(settings *collector.Settings) ([]collector.Location, error) {
+	errMissingKey := errors.New("missing API key, set --apikey or OW_APIKEY")
+	if *configFile == "" {
+		if settings.ApiKey == "" {
+			return nil, errMissingKey
+		}
+		return collector.ResolveLocations(*city)
+	}
+
+	config, err := collector.LoadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	// Only locations without their own API key need --apikey.
+	for _, location := range config.Locations {
+		if location.ApiKey == "" && settings.ApiKey == "" {
+			return nil, errMissingKey
+		}
+	}
+	return config.Resolve(settings)
+}
+
+func serve(settings *collector.Settings, locations []collector.Location) {
+	// Create a new instance of the weatherCollector with caching and
+	// register it with the prometheus client.
+	log.Infof("Cache Time set to: %s", *cacheTTL+" seconds")
+	cache := ttlcache.NewCache()
+	err := cache.SetTTL(settings.CacheTTL)
 	if err != nil {
 		return
 	}
 	cache.SkipTTLExtensionOnHit(true)
 
+	loaded, err := settings.DiskCache.Load(cache, locations)
+	if err != nil {
+		log.Error("Loading cached responses failed: ", err)
+	} else if settings.DiskCache != nil {
+		log.Infof("Loaded %d cached responses from %s", loaded, *cacheDir)
+	}
+
 	// Add some logging for extra collectors
-	if *enablePol {
+	if *enablePol || *enablePolFc {
 		log.Info("Pollution metrics enabled, this will call the API more than once per call.")
 	}
+	if *enableDaySum {
+		log.Info("Day summary metrics enabled, this will call the API one more time per call and once a day.")
+	}
 
-	settings := collector.Settings{
-		DegreesUnit: *degreesUnit, Language: *language, ApiKey: *apiKey, EnablePol: *enablePol,
+	weatherCollector := collector.NewOpenweatherCollector(settings, locations, cache)
+	if settings.Budget != nil {
+		prometheus.MustRegister(settings.Budget)
 	}
+	if !*poller && (*adaptive || *boost > 1) {
+		log.Warn("Adaptive refresh and refresh boost have no effect without --poller.")
+	}
+	if *poller {
+		log.Info("Background polling enabled, scrapes will only read cached data.")
+		weatherCollector.StartPoller(collector.PollerOptions{Adaptive: *adaptive, Boost: *boost})
+	}
+
+	// Reload the locations on SIGHUP or a POST to /-/reload.
+	var reloadLock sync.Mutex
+	reload := func() error {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+
+		locations, err := loadLocations(settings)
+		if errors.Is(err, collector.ErrGeocode) {
+			log.Error("Skipping locations: ", err)
+		} else if err != nil {
+			return err
+		}
+		weatherCollector.Reload(locations)
+		log.Infof("Reloaded %d locations", len(locations))
+		return nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				log.Error("Reload failed: ", err)
+			}
+		}
+	}()
 
-	weatherCollector := collector.NewOpenweatherCollector(&settings, *city, cache)
-	prometheus.MustRegister(weatherCollector)
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			log.Error("Reload failed: ", err)
+			http.Error(w, fmt.Sprintf("Reload failed: %s", err), http.StatusInternalServerError)
+		}
+	})
+
+	// Collect a single location per request, sharing the cache with /metrics.
+	http.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		probe(w, r, settings, cache)
+	})
 
 	// This section will start the HTTP server and expose
-	// any metrics on the /metrics endpoint.
-	http.Handle("/metrics", promhttp.Handler())
+	// any metrics on the /metrics endpoint. The weather is collected
+	// with the deadline of each scrape.
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := scrapeContext(r)
+			defer cancel()
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(weatherCollector.WithContext(ctx))
+			promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		}),
+	))
 	log.Info("Beginning to serve on port " + *addr)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
+
+// probe serves the metrics of the location in the location query parameter,
+// optionally in other units or language, in the style of the blackbox exporter.
+func probe(w http.ResponseWriter, r *http.Request, settings *collector.Settings, cache *ttlcache.Cache) {
+	params := r.URL.Query()
+
+	location := params.Get("location")
+	if location == "" {
+		http.Error(w, "Location parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if settings.ApiKey == "" {
+		http.Error(w, "Probing needs --apikey", http.StatusBadRequest)
+		return
+	}
+
+	probeSettings := *settings
+	if units := params.Get("units"); units != "" {
+		if _, ok := collector.DataUnits[units]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown unit %s (must be C, F, or K)", units), http.StatusBadRequest)
+			return
+		}
+		probeSettings.DegreesUnit = units
+	}
+	if language := params.Get("language"); language != "" {
+		probeSettings.Language = language
+	}
+
+	locations, err := collector.ResolveLocations(location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+
+	// Serve the API calls of the probe with its metrics, so probed locations
+	// don't add series to the exporter's own metrics. They are gathered after
+	// the calls were made.
+	probeSettings.Stats = collector.NewAPIStats()
+	stats := prometheus.NewRegistry()
+	stats.MustRegister(probeSettings.Stats)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector.NewOpenweatherCollector(&probeSettings, locations, cache).WithContext(ctx))
+	promhttp.HandlerFor(prometheus.Gatherers{registry, stats}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// scrapeTimeoutOffset is left of the scrape timeout to write the response.
+const scrapeTimeoutOffset = 0.5
+
+// scrapeContext returns a context that is done shortly before Prometheus gives
+// up on the scrape, according to its X-Prometheus-Scrape-Timeout-Seconds header.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	timeout = max(timeout-scrapeTimeoutOffset, timeout/2)
+	return context.WithTimeout(r.Context(), time.Duration(timeout*float64(time.Second)))
+}
+
+func backfill(settings *collector.Settings, locations []collector.Location) {
+	to := time.Now().UTC().Truncate(time.Hour)
+	if *backfillTo != "" {
+		t, err := time.Parse(time.DateOnly, *backfillTo)
+		if err != nil {
+			log.Fatal("Invalid backfill end date: ", err)
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if *backfillFrom != "" {
+		t, err := time.Parse(time.DateOnly, *backfillFrom)
+		if err != nil {
+			log.Fatal("Invalid backfill start date: ", err)
+		}
+		from = t
+	}
+
+	if !from.Before(to) || *backfillStep <= 0 {
+		log.Fatalf("Invalid backfill range %s to %s every %s", from, to, *backfillStep)
+	}
+
+	out := os.Stdout
+	if *backfillOutput != "-" {
+		f, err := os.Create(*backfillOutput)
+		if err != nil {
+			log.Fatal("Could not create backfill output: ", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var err error
+	switch *backfillSource {
+	case "pollution":
+		err = collector.BackfillPollution(out, settings, locations, from, to)
+	default:
+		err = collector.Backfill(out, settings, locations, from, to, *backfillStep)
+	}
+	if err != nil {
+		log.Fatal("Backfill failed: ", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mock serves synthetic Openweather and Nominatim responses, so the
+// exporter can be run without an API key.
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// API keys that make every Openweather request fail, to try out error handling.
+const (
+	KeyUnauthorized = "unauthorized"
+	KeyRateLimited  = "ratelimited"
+	KeyUnavailable  = "unavailable"
+)
+
+type server struct {
+	fixtures string
+	mux      *http.ServeMux
+}
+
+// NewServer returns a handler serving the Openweather endpoints used by the
+// exporter and the Nominatim search. Responses are generated from the
+// coordinates and the time, unless fixtures is a directory holding a JSON
+// file named after the endpoint, such as onecall.json, onecall_timemachine.json,
+// air_pollution.json or search.json, which is then served as is.
+func NewServer(fixtures string) http.Handler {
+	s := &server{fixtures: fixtures, mux: http.NewServeMux()}
+
+	s.handle("/data/3.0/onecall", true, oneCall)
+	s.handle("/data/3.0/onecall/timemachine", true, timeMachine)
+	s.handle("/data/3.0/onecall/day_summary", true, daySummary)
+	s.handle("/data/2.5/air_pollution", true, pollution)
+	s.handle("/data/2.5/air_pollution/forecast", true, pollutionForecast)
+	s.handle("/data/2.5/air_pollution/history", true, pollutionHistory)
+	s.handle("/search", false, search)
+
+	return s.mux
+}
+
+// fixtureName returns the fixture file of path, dropping the API version, so
+// /data/3.0/onecall/timemachine is onecall_timemachine.json.
+func fixtureName(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "data" {
+		parts = parts[2:]
+	}
+	return strings.Join(parts, "_") + ".json"
+}
+
+// handle serves path from its fixture if there is one, or else from generate.
+// Openweather endpoints check the API key first.
+func (s *server) handle(path string, checkKey bool, generate func(url.Values) (any, error)) {
+	fixture := fixtureName(path)
+
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		log.Infof("Mock request %s", r.URL.Path)
+		q := r.URL.Query()
+
+		if checkKey && !authorize(w, q.Get("appid")) {
+			return
+		}
+
+		if s.fixtures != "" {
+			bytes, err := os.ReadFile(filepath.Join(s.fixtures, fixture))
+			if err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write(bytes)
+				return
+			} else if !os.IsNotExist(err) {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		response, err := generate(q)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	})
+}
+
+// authorize fails the request like Openweather does for the special API keys,
+// and reports whether it may go on.
+func authorize(w http.ResponseWriter, appid string) bool {
+	switch appid {
+	case "", KeyUnauthorized:
+		writeError(w, http.StatusUnauthorized, "Invalid API key. Please see https://openweathermap.org/faq#error401 for more info.")
+	case KeyRateLimited:
+		writeError(w, http.StatusTooManyRequests, "Your account is temporary blocked due to exceeding of requests limitation of your subscription type.")
+	case KeyUnavailable:
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "Service Unavailable")
+	default:
+		return true
+	}
+	return false
+}
+
+// writeError writes an error in the format of Openweather.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"cod": status, "message": message})
+}
+
+// coordinates returns the lat and lon parameters of a request.
+func coordinates(q url.Values) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(q.Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("wrong latitude")
+	}
+	lon, err := strconv.ParseFloat(q.Get("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, fmt.Errorf("wrong longitude")
+	}
+	return lat, lon, nil
+}
+
+// unixParam returns a unix time parameter of a request.
+func unixParam(q url.Values, name string) (int64, error) {
+	value, err := strconv.ParseInt(q.Get(name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("wrong %s", name)
+	}
+	return value, nil
+}
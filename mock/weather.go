@@ -0,0 +1,523 @@
+// Copyright 2023 Billy Wooten
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mock
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/billykwooten/openweather-exporter/collector"
+	"github.com/billykwooten/openweather-exporter/geo"
+)
+
+// place generates the weather of a location, the same for the same
+// coordinates and time, and changing smoothly over time.
+type place struct {
+	lat, lon float64
+	// seed varies the weather between places, from 0 to 1.
+	seed float64
+	// offset of the local time from UTC in seconds.
+	offset int
+}
+
+func newPlace(lat, lon float64) place {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%.4f,%.4f", lat, lon)
+	return place{
+		lat:    lat,
+		lon:    lon,
+		seed:   float64(h.Sum64()%1000) / 1000,
+		offset: int(math.Round(lon/15)) * 3600,
+	}
+}
+
+// wave is a sine wave over time with the given period, shifted by the seed.
+func (p place) wave(t time.Time, period time.Duration, shift float64) float64 {
+	return math.Sin(2 * math.Pi * (float64(t.Unix())/period.Seconds() + p.seed + shift))
+}
+
+// localHour is the local time of day in hours.
+func (p place) localHour(t time.Time) float64 {
+	seconds := (t.Unix() + int64(p.offset)) % 86400
+	if seconds < 0 {
+		seconds += 86400
+	}
+	return float64(seconds) / 3600
+}
+
+// localMidnight is the start of the local day of t.
+func (p place) localMidnight(t time.Time) time.Time {
+	return t.Add(-time.Duration(p.localHour(t) * float64(time.Hour))).Truncate(time.Second)
+}
+
+// temperature in degrees Celsius.
+func (p place) temperature(t time.Time) float64 {
+	season := math.Cos(2 * math.Pi * float64(t.YearDay()-200) / 365)
+	if p.lat < 0 {
+		season = -season
+	}
+	daily := math.Sin(2 * math.Pi * (p.localHour(t) - 9) / 24)
+	return 27 - 0.35*math.Abs(p.lat) + 10*season*math.Abs(p.lat)/60 + 5*daily + 2*p.wave(t, 72*time.Hour, 0)
+}
+
+// precipitation in millimeters per hour, in showers every few hours.
+func (p place) precipitation(t time.Time) float64 {
+	period := time.Duration(8+10*p.seed) * time.Hour
+	return math.Round(max(0, p.wave(t, period, 0)-0.75)*10*100) / 100
+}
+
+func (p place) humidity(t time.Time) int {
+	humidity := 60 + 20*p.wave(t, 30*time.Hour, 0.25)
+	if p.precipitation(t) > 0 {
+		humidity += 20
+	}
+	return int(min(humidity, 100))
+}
+
+func (p place) clouds(t time.Time) int {
+	clouds := 40 + 40*p.wave(t, 20*time.Hour, 0.5)
+	if p.precipitation(t) > 0 {
+		clouds += 30
+	}
+	return int(min(max(clouds, 0), 100))
+}
+
+func (p place) pressure(t time.Time) int {
+	return int(1013 + 10*p.wave(t, 120*time.Hour, 0.1))
+}
+
+// windSpeed in meters per second.
+func (p place) windSpeed(t time.Time) float64 {
+	return math.Round((4+3*p.wave(t, 16*time.Hour, 0.3))*100) / 100
+}
+
+func (p place) windDeg(t time.Time) float64 {
+	return math.Round(180 + 179*p.wave(t, 48*time.Hour, 0.7))
+}
+
+func (p place) uvi(t time.Time) float64 {
+	hour := p.localHour(t)
+	if hour < 6 || hour > 18 {
+		return 0
+	}
+	clear := 1 - 0.7*float64(p.clouds(t))/100
+	return math.Round(9*math.Sin(math.Pi*(hour-6)/12)*clear*100) / 100
+}
+
+func (p place) conditions(t time.Time) []collector.Weather {
+	switch {
+	case p.precipitation(t) > 0 && p.temperature(t) < 0:
+		return []collector.Weather{{ID: 600, Main: "Snow", Description: "light snow", Icon: "13d"}}
+	case p.precipitation(t) > 0:
+		return []collector.Weather{{ID: 500, Main: "Rain", Description: "light rain", Icon: "10d"}}
+	case p.clouds(t) > 50:
+		return []collector.Weather{{ID: 804, Main: "Clouds", Description: "overcast clouds", Icon: "04d"}}
+	default:
+		return []collector.Weather{{ID: 800, Main: "Clear", Description: "clear sky", Icon: "01d"}}
+	}
+}
+
+// units converts to the units parameter of a request, Kelvin and meters per
+// second if it is not imperial or metric.
+type units string
+
+func (u units) temperature(celsius float64) float64 {
+	switch u {
+	case "imperial":
+		return math.Round((celsius*9/5+32)*100) / 100
+	case "metric":
+		return math.Round(celsius*100) / 100
+	default:
+		return math.Round((celsius+273.15)*100) / 100
+	}
+}
+
+func (u units) speed(ms float64) float64 {
+	if u == "imperial" {
+		return math.Round(ms*2.23694*100) / 100
+	}
+	return ms
+}
+
+func (p place) current(t time.Time, u units) collector.OneCallCurrentData {
+	midnight := p.localMidnight(t)
+	precipitation, temperature := p.precipitation(t), p.temperature(t)
+
+	current := collector.OneCallCurrentData{
+		Dt:         int(t.Unix()),
+		Sunrise:    int(midnight.Add(6 * time.Hour).Unix()),
+		Sunset:     int(midnight.Add(18 * time.Hour).Unix()),
+		Temp:       u.temperature(temperature),
+		FeelsLike:  u.temperature(temperature - p.windSpeed(t)/3),
+		Pressure:   p.pressure(t),
+		Humidity:   p.humidity(t),
+		DewPoint:   u.temperature(temperature - (100-float64(p.humidity(t)))/5),
+		Clouds:     p.clouds(t),
+		UVI:        p.uvi(t),
+		Visibility: 10000,
+		WindSpeed:  u.speed(p.windSpeed(t)),
+		WindGust:   u.speed(p.windSpeed(t) * 1.5),
+		WindDeg:    p.windDeg(t),
+		Weather:    p.conditions(t),
+	}
+	if precipitation > 0 && temperature < 0 {
+		current.Snow.OneH = precipitation
+	} else {
+		current.Rain.OneH = precipitation
+	}
+	return current
+}
+
+func (p place) hourly(t time.Time, u units) collector.OneCallHourlyData {
+	current := p.current(t, u)
+	pop := 0.1
+	for h := 0; h < 3; h++ {
+		if p.precipitation(t.Add(time.Duration(h)*time.Hour)) > 0 {
+			pop = 0.8
+		}
+	}
+	return collector.OneCallHourlyData{
+		Dt:         current.Dt,
+		Temp:       current.Temp,
+		FeelsLike:  current.FeelsLike,
+		Pressure:   current.Pressure,
+		Humidity:   current.Humidity,
+		DewPoint:   current.DewPoint,
+		UVI:        current.UVI,
+		Clouds:     current.Clouds,
+		Visibility: current.Visibility,
+		WindSpeed:  current.WindSpeed,
+		WindGust:   current.WindGust,
+		WindDeg:    current.WindDeg,
+		Pop:        pop,
+		Rain:       current.Rain,
+		Snow:       current.Snow,
+		Weather:    current.Weather,
+	}
+}
+
+// moonPhase is 0 at new moon and 0.5 at full moon.
+func moonPhase(t time.Time) float64 {
+	newMoon := time.Date(2000, 1, 6, 18, 14, 0, 0, time.UTC)
+	const synodicMonth = 29.530588 * 24 * 3600
+	phase := math.Mod(t.Sub(newMoon).Seconds()/synodicMonth, 1)
+	return math.Round(phase*100) / 100
+}
+
+func (p place) daily(midnight time.Time, u units) collector.OneCallDailyData {
+	noon := midnight.Add(12 * time.Hour)
+	current := p.current(noon, u)
+
+	daily := collector.OneCallDailyData{
+		Dt:        int(noon.Unix()),
+		Sunrise:   int(midnight.Add(6 * time.Hour).Unix()),
+		Sunset:    int(midnight.Add(18 * time.Hour).Unix()),
+		Moonrise:  int(midnight.Add(time.Duration(24*moonPhase(noon)) * time.Hour).Unix()),
+		Moonset:   int(midnight.Add(time.Duration(12+24*moonPhase(noon)) * time.Hour).Unix()),
+		MoonPhase: moonPhase(noon),
+		Summary:   "Synthetic weather from the mock server",
+		Pressure:  current.Pressure,
+		Humidity:  current.Humidity,
+		DewPoint:  current.DewPoint,
+		WindSpeed: current.WindSpeed,
+		WindGust:  current.WindGust,
+		WindDeg:   current.WindDeg,
+		Clouds:    current.Clouds,
+		UVI:       current.UVI,
+		Pop:       0.1,
+		Weather:   current.Weather,
+	}
+
+	minimum, maximum := math.Inf(1), math.Inf(-1)
+	for h := 0; h < 24; h++ {
+		t := midnight.Add(time.Duration(h) * time.Hour)
+		minimum, maximum = min(minimum, p.temperature(t)), max(maximum, p.temperature(t))
+		if precipitation := p.precipitation(t); precipitation > 0 {
+			daily.Pop = 0.8
+			if p.temperature(t) < 0 {
+				daily.Snow += precipitation
+			} else {
+				daily.Rain += precipitation
+			}
+		}
+	}
+	daily.Temp.Min, daily.Temp.Max = u.temperature(minimum), u.temperature(maximum)
+	daily.Temp.Morn = u.temperature(p.temperature(midnight.Add(6 * time.Hour)))
+	daily.Temp.Day = current.Temp
+	daily.Temp.Eve = u.temperature(p.temperature(midnight.Add(18 * time.Hour)))
+	daily.Temp.Night = u.temperature(p.temperature(midnight.Add(23 * time.Hour)))
+	daily.FeelsLike.Morn, daily.FeelsLike.Day = daily.Temp.Morn, current.FeelsLike
+	daily.FeelsLike.Eve, daily.FeelsLike.Night = daily.Temp.Eve, daily.Temp.Night
+	daily.Rain, daily.Snow = math.Round(daily.Rain*100)/100, math.Round(daily.Snow*100)/100
+	return daily
+}
+
+// alerts warns of heavy showers and heat within the next day.
+func (p place) alerts(now time.Time) []collector.OneCallAlert {
+	var alerts []collector.OneCallAlert
+	start := now.Truncate(time.Hour)
+	for h := 0; h < 24; h++ {
+		t := start.Add(time.Duration(h) * time.Hour)
+		if p.precipitation(t) > 2 {
+			alerts = append(alerts, collector.OneCallAlert{
+				SenderName:  "Mock Weather Service",
+				Event:       "Flood Watch",
+				Start:       int(t.Unix()),
+				End:         int(t.Add(6 * time.Hour).Unix()),
+				Description: "Heavy showers may cause flooding.",
+				Tags:        []string{"Flood"},
+			})
+			break
+		}
+	}
+	for h := 0; h < 24; h++ {
+		t := start.Add(time.Duration(h) * time.Hour)
+		if p.temperature(t) > 35 {
+			alerts = append(alerts, collector.OneCallAlert{
+				SenderName:  "Mock Weather Service",
+				Event:       "Excessive Heat Warning",
+				Start:       int(t.Unix()),
+				End:         int(t.Add(12 * time.Hour).Unix()),
+				Description: "Dangerously hot conditions.",
+				Tags:        []string{"Extreme high temperature"},
+			})
+			break
+		}
+	}
+	return alerts
+}
+
+// timezone names the fixed offset of a place.
+func (p place) timezone() string {
+	return fmt.Sprintf("Etc/GMT%+d", -p.offset/3600)
+}
+
+func oneCall(q url.Values) (any, error) {
+	lat, lon, err := coordinates(q)
+	if err != nil {
+		return nil, err
+	}
+	p, u, now := newPlace(lat, lon), units(q.Get("units")), time.Now()
+	exclude := strings.Split(q.Get("exclude"), ",")
+
+	data := collector.OneCallData{
+		Latitude:       lat,
+		Longitude:      lon,
+		Timezone:       p.timezone(),
+		TimezoneOffset: p.offset,
+	}
+	if !slices.Contains(exclude, "current") {
+		data.Current = p.current(now, u)
+	}
+	if !slices.Contains(exclude, "minutely") {
+		start := now.Truncate(time.Minute)
+		for m := 0; m <= 60; m++ {
+			t := start.Add(time.Duration(m) * time.Minute)
+			data.Minutely = append(data.Minutely, collector.OneCallMinutelyData{Dt: int(t.Unix()), Precipitation: p.precipitation(t)})
+		}
+	}
+	if !slices.Contains(exclude, "hourly") {
+		start := now.Truncate(time.Hour)
+		for h := 0; h < 48; h++ {
+			data.Hourly = append(data.Hourly, p.hourly(start.Add(time.Duration(h)*time.Hour), u))
+		}
+	}
+	if !slices.Contains(exclude, "daily") {
+		midnight := p.localMidnight(now)
+		for d := 0; d < 8; d++ {
+			data.Daily = append(data.Daily, p.daily(midnight.AddDate(0, 0, d), u))
+		}
+	}
+	if !slices.Contains(exclude, "alerts") {
+		data.Alerts = p.alerts(now)
+	}
+	return data, nil
+}
+
+func timeMachine(q url.Values) (any, error) {
+	lat, lon, err := coordinates(q)
+	if err != nil {
+		return nil, err
+	}
+	dt, err := unixParam(q, "dt")
+	if err != nil {
+		return nil, err
+	}
+	p := newPlace(lat, lon)
+
+	return collector.OneCallTimeMachineData{
+		Latitude:       lat,
+		Longitude:      lon,
+		Timezone:       p.timezone(),
+		TimezoneOffset: p.offset,
+		Data:           []collector.OneCallCurrentData{p.current(time.Unix(dt, 0), units(q.Get("units")))},
+	}, nil
+}
+
+func daySummary(q url.Values) (any, error) {
+	lat, lon, err := coordinates(q)
+	if err != nil {
+		return nil, err
+	}
+	date, err := time.Parse(time.DateOnly, q.Get("date"))
+	if err != nil {
+		return nil, fmt.Errorf("wrong date")
+	}
+	p, u := newPlace(lat, lon), units(q.Get("units"))
+	midnight := date.Add(-time.Duration(p.offset) * time.Second)
+
+	summary := collector.DaySummaryData{
+		Latitude:  lat,
+		Longitude: lon,
+		Tz:        fmt.Sprintf("%+03d:00", p.offset/3600),
+		Date:      date.Format(time.DateOnly),
+		Units:     cmp.Or(q.Get("units"), "standard"),
+	}
+	at := func(hour int) time.Time { return midnight.Add(time.Duration(hour) * time.Hour) }
+
+	minimum, maximum := math.Inf(1), math.Inf(-1)
+	for h := 0; h < 24; h++ {
+		t := at(h)
+		minimum, maximum = min(minimum, p.temperature(t)), max(maximum, p.temperature(t))
+		summary.Precipitation.Total += p.precipitation(t)
+		if speed := u.speed(p.windSpeed(t)); speed > summary.Wind.Max.Speed {
+			summary.Wind.Max.Speed, summary.Wind.Max.Direction = speed, p.windDeg(t)
+		}
+	}
+	summary.Precipitation.Total = math.Round(summary.Precipitation.Total*100) / 100
+	summary.Temperature.Min, summary.Temperature.Max = u.temperature(minimum), u.temperature(maximum)
+	summary.Temperature.Morning = u.temperature(p.temperature(at(6)))
+	summary.Temperature.Afternoon = u.temperature(p.temperature(at(12)))
+	summary.Temperature.Evening = u.temperature(p.temperature(at(18)))
+	summary.Temperature.Night = u.temperature(p.temperature(at(0)))
+	summary.Humidity.Afternoon = float64(p.humidity(at(12)))
+	summary.CloudCover.Afternoon = float64(p.clouds(at(12)))
+	summary.Pressure.Afternoon = float64(p.pressure(at(12)))
+	return summary, nil
+}
+
+// airQuality returns the air pollution of a place at t, in μg/m3.
+func (p place) airQuality(t time.Time) collector.PollutionData {
+	var data collector.PollutionData
+	data.Dt = int(t.Unix())
+
+	level := 1 + p.wave(t, 26*time.Hour, 0.6)
+	c := &data.Components
+	c.Pm25 = math.Round((5+30*p.seed+10*level)*100) / 100
+	c.Pm10 = math.Round(c.Pm25*1.6*100) / 100
+	c.Co = math.Round((200+150*level)*100) / 100
+	c.No = math.Round((0.5+2*level)*100) / 100
+	c.No2 = math.Round((5+15*level)*100) / 100
+	c.O3 = math.Round((40+30*p.wave(t, 24*time.Hour, 0.4)+30)*100) / 100
+	c.So2 = math.Round((1+4*level)*100) / 100
+	c.Nh3 = math.Round((0.5+3*level)*100) / 100
+
+	// The air quality index follows PM2.5, https://openweathermap.org/api/air-pollution
+	switch {
+	case c.Pm25 < 10:
+		data.Main.Aqi = 1
+	case c.Pm25 < 25:
+		data.Main.Aqi = 2
+	case c.Pm25 < 50:
+		data.Main.Aqi = 3
+	case c.Pm25 < 75:
+		data.Main.Aqi = 4
+	default:
+		data.Main.Aqi = 5
+	}
+	return data
+}
+
+// pollutionList returns hourly air pollution from start, for the given hours.
+func pollutionList(q url.Values, start time.Time, hours int) (any, error) {
+	lat, lon, err := coordinates(q)
+	if err != nil {
+		return nil, err
+	}
+	p := newPlace(lat, lon)
+
+	var pollution collector.Pollution
+	pollution.Location.Latitude, pollution.Location.Longitude = lat, lon
+	for h := 0; h < hours; h++ {
+		pollution.List = append(pollution.List, p.airQuality(start.Add(time.Duration(h)*time.Hour)))
+	}
+	return pollution, nil
+}
+
+func pollution(q url.Values) (any, error) {
+	return pollutionList(q, time.Now().Truncate(time.Hour), 1)
+}
+
+func pollutionForecast(q url.Values) (any, error) {
+	return pollutionList(q, time.Now().Truncate(time.Hour).Add(time.Hour), 96)
+}
+
+// maxHistoryHours limits the air pollution history of a request to a year.
+const maxHistoryHours = 366 * 24
+
+func pollutionHistory(q url.Values) (any, error) {
+	start, err := unixParam(q, "start")
+	if err != nil {
+		return nil, err
+	}
+	end, err := unixParam(q, "end")
+	if err != nil {
+		return nil, err
+	}
+	from := time.Unix(start, 0).Truncate(time.Hour)
+	if from.Unix() < start {
+		from = from.Add(time.Hour)
+	}
+	hours := int(time.Unix(end, 0).Sub(from)/time.Hour) + 1
+	return pollutionList(q, from, min(max(hours, 0), maxHistoryHours))
+}
+
+// search returns a single place for any query, with coordinates derived from it.
+func search(q url.Values) (any, error) {
+	query := q.Get("q")
+	if query == "" {
+		return []geo.SearchResult{}, nil
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strings.ToLower(query)))
+	sum := h.Sum64()
+	lat := math.Round((-55+125*float64(sum%100000)/100000)*10000) / 10000
+	lon := math.Round((-180+360*float64((sum/100000)%100000)/100000)*10000) / 10000
+	if lat == 0 {
+		lat = 0.0001
+	}
+
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', 7, 64) }
+	return []geo.SearchResult{{
+		PlaceID:        int(sum % 1000000),
+		License:        "Synthetic data from the openweather-exporter mock server",
+		OSMType:        "relation",
+		OSMID:          int(sum % 100000000),
+		BoundingBoxStr: []string{format(lat - 0.1), format(lat + 0.1), format(lon - 0.1), format(lon + 0.1)},
+		LatStr:         format(lat),
+		LngStr:         format(lon),
+		DisplayName:    query,
+		Class:          "boundary",
+		Type:           "administrative",
+		Importance:     0.7,
+	}}, nil
+}